@@ -17,24 +17,52 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"github.com/outbrain/golib/log"
 	"github.com/outbrain/zookeepercli/go/output"
 	"github.com/outbrain/zookeepercli/go/zk"
+	zkapi "github.com/samuel/go-zookeeper/zk"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/signal"
+	gopath "path"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// fileCommands take a local file, rather than a path, as their argument
+var fileCommands = map[string]bool{
+	"applyaclpolicy": true,
+	"import":         true,
+	"provision":      true,
+}
+
+// chrootPath returns the path argument of given command under given chroot, if any. The argument of commands
+// taking a file is left as is.
+func chrootPath(command string, path string, chroot string) string {
+	if chroot == "" || fileCommands[command] {
+		return path
+	}
+	return gopath.Join(chroot, path)
+}
+
 // main is the application's entry point.
 func main() {
-	servers := flag.String("servers", "", "srv1[:port1][,srv2[:port2]...]")
-	command := flag.String("c", "", "command, required (exists|get|ls|lsr|create|creater|set|delete|rm|deleter|rmr|getacl|setacl)")
+	servers := flag.String("servers", "", "srv1[:port1][,srv2[:port2]...][/chroot]")
+	serversFile := flag.String("servers_file", "", "optional, file listing servers one per line, each srv[:port][/chroot], instead of --servers")
+	command := flag.String("c", "", "command, required (exists|get|ls|lsr|create|creater|set|delete|rm|deleter|rmr|getacl|setacl|worldwritable|checkintegrity|getlines|diag|exportscript|settagged|lscreated|cleanupmarker|applyaclpolicy|latency|validateschema|getauto|quorum|tail|access|walkstats|emptyleaves|setaclr|provision|export|import|setchunked|getchunked|cpr|mv)")
 	force := flag.Bool("force", false, "force operation")
+	inheritACL := flag.Bool("inherit_acl", false, "with force, create missing parents with the ACL of their nearest existing ancestor")
+	backup := flag.Bool("backup", false, "with set, first copy current data to a timestamped child of <path>/.bak")
+	sync := flag.Bool("sync", false, "with get, sync with the leader first, so as not to read stale data")
+	ephemeral := flag.Bool("ephemeral", false, "with create, create an ephemeral node, held until interrupted")
+	sequential := flag.Bool("sequential", false, "with create, append a sequence number to the node name; prints the created path")
+	dryRun := flag.Bool("dry_run", false, "only report what a destructive operation would do")
 	format := flag.String("format", "txt", "output format (txt|json)")
 	omitNewline := flag.Bool("n", false, "omit trailing newline with get in txt format")
 	verbose := flag.Bool("verbose", false, "verbose")
@@ -42,6 +70,15 @@ func main() {
 	stack := flag.Bool("stack", false, "add stack trace upon error")
 	authUser := flag.String("auth_usr", "", "optional, digest scheme, user")
 	authPwd := flag.String("auth_pwd", "", "optional, digest scheme, pwd")
+	sessionTimeout := flag.Duration("session_timeout", time.Second, "optional, session timeout requested from the servers")
+	proxy := flag.String("proxy", "", "optional, connect through proxy: socks5://[user:pwd@]host[:port] or http://[user:pwd@]host[:port]")
+	useTLS := flag.Bool("tls", false, "optional, connect over TLS, as to a secure client port")
+	tlsCA := flag.String("tls_ca", "", "optional, with tls, PEM file of CA certificates to trust instead of the system's")
+	tlsCert := flag.String("tls_cert", "", "optional, with tls, PEM file of client certificate, for mutual TLS")
+	tlsKey := flag.String("tls_key", "", "optional, with tls, PEM file of client key, for mutual TLS")
+	rateLimit := flag.Int("rate_limit", 0, "optional, max operations per second issued by recursive and bulk commands (0 for unlimited)")
+	retryAttempts := flag.Int("retry_attempts", 1, "optional, attempts of requests failing for a lost connection, retried with exponential backoff")
+	retryBackoff := flag.Duration("retry_backoff", 100*time.Millisecond, "optional, with retry_attempts, wait before the first retry, doubled before each further one")
 	acls := flag.String("acls", "31", "optional, csv list [1|,2|,4|,8|,16|,31]")
 	flag.Parse()
 
@@ -62,7 +99,7 @@ func main() {
 	var out output.Printer
 	switch *format {
 	case "txt":
-		out = &output.TxtPrinter{*omitNewline}
+		out = &output.TxtPrinter{OmitTrailingNL: *omitNewline}
 	case "json":
 		out = &output.JSONPrinter{}
 	default:
@@ -71,19 +108,16 @@ func main() {
 
 	log.Info("starting")
 
-	if *servers == "" {
-		log.Fatal("Expected comma delimited list of servers via --servers")
-	}
-	serversArray := strings.Split(*servers, ",")
-	if len(serversArray) == 0 {
-		log.Fatal("Expected comma delimited list of servers via --servers")
+	if *servers == "" && *serversFile == "" {
+		log.Fatal("Expected comma delimited list of servers via --servers, or a file via --servers_file")
 	}
-
 	if len(*command) == 0 {
-		log.Fatal("Expected command (-c) (exists|get|ls|lsr|create|creater|set|delete|rm|deleter|rmr|getacl|setacl)")
+		log.Fatal("Expected command (-c) (exists|get|ls|lsr|create|creater|set|delete|rm|deleter|rmr|getacl|setacl|worldwritable|checkintegrity|getlines|diag|exportscript|settagged|lscreated|cleanupmarker|applyaclpolicy|latency|validateschema|getauto|quorum|tail|access|walkstats|emptyleaves|setaclr|provision|export|import|setchunked|getchunked|cpr|mv)")
 	}
 
-	if len(flag.Args()) < 1 {
+	// These commands operate on the connection rather than on a path
+	pathless := *command == "diag" || *command == "quorum"
+	if len(flag.Args()) < 1 && !pathless {
 		log.Fatal("Expected path argument")
 	}
 	path := flag.Arg(0)
@@ -98,7 +132,40 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 	zook := zk.NewZooKeeper()
-	zook.SetServers(serversArray)
+	var chroot string
+	var err error
+	if *serversFile != "" {
+		if chroot, err = zook.LoadServersFromFile(*serversFile); err != nil {
+			log.Fatale(err)
+		}
+	} else {
+		var serversArray []string
+		if serversArray, chroot, err = zk.SplitChroot(strings.Split(*servers, ",")); err != nil {
+			log.Fatale(err)
+		}
+		zook.SetServers(serversArray)
+	}
+	if !pathless {
+		path = chrootPath(*command, path, chroot)
+	}
+	zook.SetRateLimit(*rateLimit)
+	zook.SetInheritParentACL(*inheritACL)
+	if err := zook.SetSessionTimeout(*sessionTimeout); err != nil {
+		log.Fatale(err)
+	}
+	if err := zook.SetRetryPolicy(*retryAttempts, *retryBackoff); err != nil {
+		log.Fatale(err)
+	}
+	if err := zook.SetProxy(*proxy); err != nil {
+		log.Fatale(err)
+	}
+	if *useTLS {
+		tlsConfig, err := zk.LoadTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatale(err)
+		}
+		zook.SetTLSConfig(tlsConfig)
+	}
 
 	if *authUser != "" && *authPwd != "" {
 		authExp := fmt.Sprint(*authUser, ":", *authPwd)
@@ -120,12 +187,67 @@ func main() {
 		}
 	case "get":
 		{
-			if result, err := zook.Get(path); err == nil {
+			get := zook.Get
+			if *sync {
+				get = zook.GetAfterSync
+			}
+			if result, err := get(path); err == nil {
+				out.PrintString(result)
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "getauto":
+		{
+			if result, decompressed, err := zook.GetAuto(path); err == nil {
+				log.Infof("Decompressed: %t", decompressed)
 				out.PrintString(result)
 			} else {
 				log.Fatale(err)
 			}
 		}
+	case "getlines":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected match argument")
+			}
+			if result, err := zook.GetLines(path, flag.Arg(1)); err == nil {
+				out.PrintStringArray(result)
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "validateschema":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected required paths argument")
+			}
+			splitPaths := func(csv string) []string {
+				if csv == "" {
+					return []string{}
+				}
+				return strings.Split(csv, ",")
+			}
+			violations, err := zook.ValidateSchema(path, splitPaths(flag.Arg(1)), splitPaths(flag.Arg(2)))
+			if err != nil {
+				log.Fatale(err)
+			}
+			out.PrintStringArray(violations)
+			if len(violations) > 0 {
+				os.Exit(1)
+			}
+		}
+	case "emptyleaves":
+		{
+			emptyLeaves, err := zook.RequireNonEmptyLeaves(path)
+			if err != nil {
+				log.Fatale(err)
+			}
+			out.PrintStringArray(emptyLeaves)
+			if len(emptyLeaves) > 0 {
+				os.Exit(1)
+			}
+		}
 	case "getacl":
 		{
 			if result, err := zook.GetACL(path); err == nil {
@@ -156,6 +278,18 @@ func main() {
 				log.Fatale(err)
 			}
 		}
+	case "lscreated":
+		{
+			if result, err := zook.ChildrenByCreation(path); err == nil {
+				children := []string{}
+				for _, child := range result {
+					children = append(children, fmt.Sprintf("%s 0x%x", child.Name, child.Stat.Czxid))
+				}
+				out.PrintStringArray(children)
+			} else {
+				log.Fatale(err)
+			}
+		}
 	case "create":
 		{
 			var aclstr string
@@ -168,7 +302,37 @@ func main() {
 				aclstr = flag.Arg(2)
 			}
 
-			if *authUser != "" && *authPwd != "" {
+			if *ephemeral || *sequential {
+				if *force || *authUser != "" {
+					log.Fatal("--ephemeral and --sequential do not support --force nor --auth_usr")
+				}
+				client, err := zook.NewClient()
+				if err != nil {
+					log.Fatale(err)
+				}
+				defer client.Close()
+				var flags int32
+				if *ephemeral {
+					flags |= zkapi.FlagEphemeral
+				}
+				if *sequential {
+					flags |= zkapi.FlagSequence
+				}
+				result, err := client.CreateWithFlags(path, []byte(flag.Arg(1)), aclstr, flags)
+				if err != nil {
+					log.Fatale(err)
+				}
+				log.Infof("Created %+v", result)
+				if *sequential {
+					out.PrintString([]byte(result))
+				}
+				if *ephemeral {
+					// the node lives as long as our session
+					interrupted := make(chan os.Signal, 1)
+					signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+					<-interrupted
+				}
+			} else if *authUser != "" && *authPwd != "" {
 				perms, err := zook.BuildACL("digest", *authUser, *authPwd, *acls)
 				if err != nil {
 					log.Fatale(err)
@@ -198,12 +362,51 @@ func main() {
 					log.Fatale(err)
 				}
 			}
-			if result, err := zook.Set(path, info); err == nil {
+			set := zook.Set
+			if *backup {
+				set = zook.SetWithBackup
+			}
+			if result, err := set(path, info); err == nil {
 				log.Infof("Set %+v", result)
 			} else {
 				log.Fatale(err)
 			}
 		}
+	case "setchunked":
+		{
+			var info []byte
+			if len(flag.Args()) > 1 {
+				info = []byte(flag.Arg(1))
+			} else {
+				var err error
+				info, err = ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					log.Fatale(err)
+				}
+			}
+			if err := zook.SetChunked(path, info, zk.DefaultChunkSize); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "getchunked":
+		{
+			// streamed as is, whatever the output format, as chunked data is typically large
+			if err := zook.GetTo(path, os.Stdout); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "settagged":
+		{
+			if len(flag.Args()) < 3 {
+				log.Fatal("Expected data and tag arguments")
+			}
+			tag := []byte(flag.Arg(2))
+			count, err := zook.SetTagged(path, []byte(flag.Arg(1)), func(data []byte) bool { return bytes.Contains(data, tag) })
+			log.Infof("Set %d nodes", count)
+			if err != nil {
+				log.Fatale(err)
+			}
+		}
 	case "setacl":
 		{
 			var aclstr string
@@ -217,12 +420,188 @@ func main() {
 					log.Fatale(err)
 				}
 			}
-			if result, err := zook.SetACL(path, aclstr, *force); err == nil {
+			if *dryRun {
+				if result, err := zook.SetACLWithDryRun(path, aclstr, *force, true); err == nil {
+					out.PrintStringArray(result)
+				} else {
+					log.Fatale(err)
+				}
+			} else if result, err := zook.SetACL(path, aclstr, *force); err == nil {
 				log.Infof("Set %+v", result)
 			} else {
 				log.Fatale(err)
 			}
 		}
+	case "setaclr":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected acl argument")
+			}
+			changes, err := zook.SetACLRecursive(path, flag.Arg(1), *dryRun)
+			if err != nil {
+				log.Fatale(err)
+			}
+			result := []string{}
+			for _, change := range changes {
+				result = append(result, change.String())
+			}
+			out.PrintStringArray(result)
+		}
+	case "access":
+		{
+			if result, err := zook.EffectiveAccess(path); err == nil {
+				out.PrintString([]byte(result))
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "worldwritable":
+		{
+			if result, err := zook.FindWorldWritable(path); err == nil {
+				out.PrintStringArray(result)
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "checkintegrity":
+		{
+			if issues, err := zook.CheckIntegrity(path); err == nil {
+				result := []string{}
+				for _, issue := range issues {
+					result = append(result, issue.String())
+				}
+				out.PrintStringArray(result)
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "diag":
+		{
+			if report, err := zook.ConnectAndReport(); err == nil {
+				out.PrintStringArray([]string{
+					fmt.Sprintf("server: %s", report.Server),
+					fmt.Sprintf("session_id: 0x%x", report.SessionID),
+					fmt.Sprintf("requested_timeout: %s", report.RequestedTimeout),
+					fmt.Sprintf("negotiated_timeout: %s", report.NegotiatedTimeout),
+					fmt.Sprintf("read_only: %t", report.ReadOnly),
+				})
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "tail":
+		{
+			if err := zook.TailChildren(path, os.Stdout); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "walkstats":
+		{
+			if result, stats, err := zook.ChildrenRecursiveWithStats(path); err == nil {
+				log.Infof("Listed %d descendants of %s", len(result), path)
+				out.PrintString([]byte(stats.String()))
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "quorum":
+		{
+			hasQuorum, err := zook.HasQuorum()
+			if err != nil {
+				log.Fatale(err)
+			}
+			out.PrintString([]byte(fmt.Sprintf("%t", hasQuorum)))
+			if !hasQuorum {
+				os.Exit(1)
+			}
+		}
+	case "exportscript":
+		{
+			if err := zook.ExportAsScript(path, os.Stdout); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "cleanupmarker":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected marker argument")
+			}
+			result, err := zook.CleanupByMarker(path, []byte(flag.Arg(1)), *dryRun)
+			out.PrintStringArray(result)
+			if err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "applyaclpolicy":
+		{
+			// The path argument is the policy file
+			result, err := zook.ApplyACLPolicy(path, *dryRun)
+			out.PrintStringArray(result)
+			if err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "export":
+		{
+			if result, err := zook.ExportSubtree(path); err == nil {
+				out.PrintString(result)
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "import":
+		{
+			// The path argument is the export document
+			document, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Fatale(err)
+			}
+			if err := zook.ImportSubtree(document, *force); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "provision":
+		{
+			// The path argument is the spec file
+			report, err := zook.Provision(path, *dryRun)
+			actions := []string{}
+			for _, action := range report.Actions {
+				actions = append(actions, action.String())
+			}
+			if !*dryRun {
+				actions = actions[:report.Applied]
+			}
+			out.PrintStringArray(actions)
+			if err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "latency":
+		{
+			if latency, err := zook.RoundTripLatency(path, true); err == nil {
+				out.PrintString([]byte(latency.String()))
+			} else {
+				log.Fatale(err)
+			}
+		}
+	case "cpr":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected destination path argument")
+			}
+			if err := zook.CopyRecursive(path, gopath.Join(chroot, flag.Arg(1)), *force); err != nil {
+				log.Fatale(err)
+			}
+		}
+	case "mv":
+		{
+			if len(flag.Args()) < 2 {
+				log.Fatal("Expected destination path argument")
+			}
+			if err := zook.Move(path, gopath.Join(chroot, flag.Arg(1))); err != nil {
+				log.Fatale(err)
+			}
+		}
 	case "delete", "rm":
 		{
 			if err := zook.Delete(path); err != nil {
@@ -234,7 +613,13 @@ func main() {
 			if !(*force) {
 				log.Fatal("deleter (recursive) command requires --force for safety measure")
 			}
-			if err := zook.DeleteRecursive(path); err != nil {
+			if *dryRun {
+				if result, err := zook.DeleteRecursiveWithDryRun(path, true); err == nil {
+					out.PrintStringArray(result)
+				} else {
+					log.Fatale(err)
+				}
+			} else if err := zook.DeleteRecursive(path); err != nil {
 				log.Fatale(err)
 			}
 		}
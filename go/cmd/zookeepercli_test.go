@@ -0,0 +1,42 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestChrootPath(t *testing.T) {
+	cases := []struct {
+		command string
+		path    string
+		chroot  string
+		want    string
+	}{
+		{"get", "/demo", "", "/demo"},
+		{"get", "/demo", "/app", "/app/demo"},
+		{"ls", "/", "/app", "/app"},
+		{"import", "demo.json", "/app", "demo.json"},
+		{"provision", "spec.json", "/app", "spec.json"},
+		{"applyaclpolicy", "/etc/policy.json", "/app", "/etc/policy.json"},
+	}
+	for _, c := range cases {
+		if got := chrootPath(c.command, c.path, c.chroot); got != c.want {
+			t.Errorf("chrootPath(%q, %q, %q) == %q, want %q", c.command, c.path, c.chroot, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"net"
+	gopath "path"
+	"sort"
+	"strings"
+)
+
+// GenerateDigest returns the id of a digest scheme ACL entry for given credentials, "user:hash", as the server
+// computes it when authenticating: hash is the base64 encoded SHA-1 of "user:password". Such an id, followed by
+// ":perms", is a digest entry setacl accepts; it also serves as the server's superDigest setting.
+func GenerateDigest(user string, password string) string {
+	hash := sha1.Sum([]byte(user + ":" + password))
+	return user + ":" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// SetWorldWritablePerms sets the permissions which, when granted to world:anyone, make
+// FindWorldWritable flag a node. Defaults to write, create, delete & admin.
+func (zook *ZooKeeper) SetWorldWritablePerms(perms int32) {
+	zook.worldWritablePerms = perms
+}
+
+// FindWorldWritable returns the given path and any of its descendants whose ACL grants world:anyone
+// any of the flagged permissions (see SetWorldWritablePerms).
+func (zook *ZooKeeper) FindWorldWritable(path string) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	result := []string{}
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(nodePath)
+		if err != nil {
+			return result, wrapError(nodePath, err)
+		}
+		for _, entry := range acl {
+			if entry.Scheme == "world" && entry.ID == "anyone" && entry.Perms&zook.worldWritablePerms != 0 {
+				result = append(result, nodePath)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// ACLIDMatch determines how FindACLReferences matches ACL entry ids
+type ACLIDMatch int
+
+const (
+	// ACLIDExact matches the id as is, e.g. the full user:base64digest of a digest entry
+	ACLIDExact ACLIDMatch = iota
+	// ACLIDPrefix matches ids starting with given id, e.g. "user:" for any digest of a user
+	ACLIDPrefix
+	// ACLIDContains matches ids containing given id
+	ACLIDContains
+)
+
+// matches tells whether an ACL entry id matches given id
+func (match ACLIDMatch) matches(entryID string, id string) bool {
+	switch match {
+	case ACLIDPrefix:
+		return strings.HasPrefix(entryID, id)
+	case ACLIDContains:
+		return strings.Contains(entryID, id)
+	}
+	return entryID == id
+}
+
+// FindACLReferences returns the given path and any of its descendants whose ACL has an entry of given scheme
+// with an id matching given id, e.g. to find where a digest credential is referenced before rotating it.
+func (zook *ZooKeeper) FindACLReferences(path string, scheme, id string, match ACLIDMatch) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	result := []string{}
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(nodePath)
+		if err != nil {
+			return result, wrapError(nodePath, err)
+		}
+		for _, entry := range acl {
+			if entry.Scheme == scheme && match.matches(entry.ID, id) {
+				result = append(result, nodePath)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// aclPermsByIdentity maps each scheme:id of given ACL to its permissions
+func aclPermsByIdentity(acl []zk.ACL) map[zk.ACL]int32 {
+	result := make(map[zk.ACL]int32)
+	for _, entry := range acl {
+		identity := zk.ACL{Scheme: entry.Scheme, ID: entry.ID}
+		result[identity] |= entry.Perms
+	}
+	return result
+}
+
+// ACLEqual returns true when both ACLs grant the same permissions to the same identities, regardless of
+// entry order. Repeated entries for the same scheme:id are merged.
+func ACLEqual(a, b []zk.ACL) bool {
+	aPerms, bPerms := aclPermsByIdentity(a), aclPermsByIdentity(b)
+	if len(aPerms) != len(bPerms) {
+		return false
+	}
+	for identity, perms := range aPerms {
+		if otherPerms, ok := bPerms[identity]; !ok || otherPerms != perms {
+			return false
+		}
+	}
+	return true
+}
+
+// authIdentities returns the scheme:id identities a session of ours authenticates as: the digest of our auth,
+// if any, and an ip identity per address of the local host's interfaces. The server sees the address the
+// connection originates from, which behind NAT is none of these.
+func (zook *ZooKeeper) authIdentities() []zk.ACL {
+	identities := []zk.ACL{}
+	if zook.authScheme == "digest" {
+		credentials := strings.SplitN(string(zook.authExpression), ":", 2)
+		if len(credentials) == 2 {
+			identities = append(identities, zk.DigestACL(0, credentials[0], credentials[1])...)
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				identities = append(identities, zk.ACL{Scheme: "ip", ID: ipNet.IP.String()})
+			}
+		}
+	}
+	return identities
+}
+
+// aclPermsFor returns the permissions given ACL grants a session authenticated as any of given identities,
+// following the server's rule: an empty ACL grants everything, world:anyone matches every session, and an
+// ip entry may be a single address or a network in CIDR notation.
+func aclPermsFor(acl []zk.ACL, identities []zk.ACL) int32 {
+	if len(acl) == 0 {
+		return zk.PermAll
+	}
+	var perms int32
+	for _, entry := range acl {
+		if entry.Scheme == "world" && entry.ID == "anyone" {
+			perms |= entry.Perms
+			continue
+		}
+		for _, identity := range identities {
+			if identity.Scheme != entry.Scheme {
+				continue
+			}
+			if identity.ID == entry.ID {
+				perms |= entry.Perms
+				break
+			}
+			if entry.Scheme == "ip" {
+				if _, network, err := net.ParseCIDR(entry.ID); err == nil && network.Contains(net.ParseIP(identity.ID)) {
+					perms |= entry.Perms
+					break
+				}
+			}
+		}
+	}
+	return perms
+}
+
+// aclGrants tells whether given ACL grants perm to a session authenticated as any of given identities
+func aclGrants(acl []zk.ACL, identities []zk.ACL, perm int32) bool {
+	return aclPermsFor(acl, identities)&perm != 0
+}
+
+// PredictDeleteFailures returns the nodes a recursive delete of given path would fail to remove for lack of
+// permission. ZooKeeper authorizes deleting a node by the delete permission on its parent, so each node is
+// judged by its parent's ACL. A node with children is only removed once they are, which requires listing them,
+// hence the read permission on the node itself: a node we cannot list is returned, while its descendants, which
+// cannot be listed either, are not. Our identity is taken to be our digest auth and the local host's addresses
+// (see authIdentities). A super user, or auth by other schemes, is not accounted for in the delete permission,
+// so the prediction may be pessimistic in such setups.
+func (zook *ZooKeeper) PredictDeleteFailures(path string) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	if exists, _, err := connection.Exists(path); err != nil {
+		return nil, wrapError(path, err)
+	} else if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	result := []string{}
+	err = zook.predictDeleteFailuresInternal(connection, path, zook.authIdentities(), make(map[string]bool), &result)
+	return result, wrapError(path, err)
+}
+
+// predictDeleteFailuresInternal: appends given path to result, should its parent not grant delete, then walks its
+// children, appending the path should it have children it cannot list
+func (zook *ZooKeeper) predictDeleteFailuresInternal(connection *zk.Conn, nodePath string, identities []zk.ACL, deletable map[string]bool, result *[]string) error {
+	failed := nodePath == "/"
+	if !failed {
+		parentPath := gopath.Dir(nodePath)
+		allowed, ok := deletable[parentPath]
+		if !ok {
+			zook.throttle(1)
+			acl, _, err := connection.GetACL(parentPath)
+			if err != nil {
+				return err
+			}
+			allowed = aclGrants(acl, identities, zk.PermDelete)
+			deletable[parentPath] = allowed
+		}
+		failed = !allowed
+	}
+	if failed {
+		*result = append(*result, nodePath)
+	}
+
+	zook.throttle(1)
+	children, _, err := connection.Children(nodePath)
+	if err == zk.ErrNoAuth {
+		// A leaf needs no listing; the stat is not subject to the ACL
+		zook.throttle(1)
+		if _, stat, err := connection.Exists(nodePath); err == nil && stat.NumChildren > 0 && !failed {
+			*result = append(*result, nodePath)
+		}
+		return nil
+	}
+	if err == zk.ErrNoNode {
+		// deleted since listed by its parent
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		if err := zook.predictDeleteFailuresInternal(connection, gopath.Join(nodePath, child), identities, deletable, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EffectiveAccess returns the permissions we have on given path, as letters (e.g. "rw" or "cdrwa"): the union
+// of the permissions its ACL grants to world:anyone and to our identities (see authIdentities). The same
+// caveats as with PredictDeleteFailures apply: super users and auth by other schemes are not accounted for.
+func (zook *ZooKeeper) EffectiveAccess(path string) (string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+
+	acl, _, err := connection.GetACL(path)
+	if err != nil {
+		return "", wrapError(path, err)
+	}
+	return permsToString(aclPermsFor(acl, zook.authIdentities())), nil
+}
+
+// GetACLRecursive returns the ACL of given path and of each of its descendants, keyed by path, each in the
+// format of GetACL. The result may be fed back to SetACLRecursiveFromMap.
+func (zook *ZooKeeper) GetACLRecursive(path string) (map[string][]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	result := make(map[string][]string)
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(nodePath)
+		if err != nil {
+			return nil, wrapError(nodePath, err)
+		}
+		result[nodePath] = zook.aclsToString(acl)
+	}
+	return result, nil
+}
+
+// SetACLRecursiveFromMap sets the ACL of each path in given map, as returned by GetACLRecursive. All ACLs are
+// parsed before any is set. Setting an ACL requires admin permission on the node itself only, so deeper paths
+// are set first: should a node's new ACL revoke our access, its descendants have already been set. It carries
+// on past per node failures, returning them in a MultiError.
+func (zook *ZooKeeper) SetACLRecursiveFromMap(aclMap map[string][]string) error {
+	acls := make(map[string][]zk.ACL)
+	paths := []string{}
+	for nodePath, aclStrings := range aclMap {
+		acl, err := zook.parseACLString(strings.Join(aclStrings, ","))
+		if err != nil {
+			return fmt.Errorf("%s: %w", nodePath, wrapError(nodePath, err))
+		}
+		acls[nodePath] = acl
+		paths = append(paths, nodePath)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if depthI, depthJ := strings.Count(paths[i], "/"), strings.Count(paths[j], "/"); depthI != depthJ {
+			return depthI > depthJ
+		}
+		return paths[i] < paths[j]
+	})
+
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	errs := MultiError{}
+	for _, nodePath := range paths {
+		if _, err := zook.setNodeACL(connection, nodePath, acls[nodePath], -1); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodePath, wrapError(nodePath, err)))
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// nodePathsInternal returns given path, followed with recursive by its descendants in pre-order
+func (zook *ZooKeeper) nodePathsInternal(connection *zk.Conn, path string, recursive bool) ([]string, error) {
+	nodePaths := []string{path}
+	if !recursive {
+		return nodePaths, nil
+	}
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	for _, relativePath := range descendants {
+		nodePaths = append(nodePaths, gopath.Join(path, relativePath))
+	}
+	return nodePaths, nil
+}
+
+// EnsureACLEntry makes sure the ACL of given path, and with recursive of each of its descendants, grants at
+// least given permissions to scheme:id, e.g. so that a monitoring identity may read everywhere. Missing
+// permissions are added to the node's existing entry for scheme:id, or in a new entry; other entries are kept.
+// Writes are conditional on the ACL version read, and retried upon concurrent ACL changes (see
+// SetUpdateAttempts). It returns the nodes whose ACL was updated.
+func (zook *ZooKeeper) EnsureACLEntry(path string, scheme, id, perms string, recursive bool) ([]string, error) {
+	requiredPerms, err := zook.parsePermsString(perms)
+	if err != nil {
+		return nil, err
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	nodePaths, err := zook.nodePathsInternal(connection, path, recursive)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	identity := zk.ACL{Scheme: scheme, ID: id}
+	updated := []string{}
+	for _, nodePath := range nodePaths {
+		for attempt := 1; ; attempt++ {
+			zook.throttle(1)
+			acl, stat, err := connection.GetACL(nodePath)
+			if err != nil {
+				return updated, wrapError(nodePath, err)
+			}
+			if aclPermsByIdentity(acl)[identity]&requiredPerms == requiredPerms {
+				break
+			}
+			ensured := []zk.ACL{}
+			found := false
+			for _, entry := range acl {
+				if entry.Scheme == scheme && entry.ID == id && !found {
+					entry.Perms |= requiredPerms
+					found = true
+				}
+				ensured = append(ensured, entry)
+			}
+			if !found {
+				ensured = append(ensured, zk.ACL{Scheme: scheme, ID: id, Perms: requiredPerms})
+			}
+			_, err = zook.setNodeACL(connection, nodePath, ensured, stat.Aversion)
+			if err == nil {
+				updated = append(updated, nodePath)
+				break
+			}
+			if err != zk.ErrBadVersion || attempt >= zook.updateAttempts {
+				return updated, wrapError(nodePath, err)
+			}
+			log.Debugf("Concurrent ACL modification of %s, retrying", nodePath)
+		}
+	}
+	return updated, nil
+}
+
+// ReplaceACLIdentity rewrites, on given path and with recursive on each of its descendants, ACL entries of
+// oldScheme:oldId to newScheme:newId, keeping their permissions and all other entries, e.g. to migrate from a
+// rotated digest credential. Should a node already have an entry for newScheme:newId, the permissions are
+// merged into it. Nodes are updated top down. Writes are conditional on the ACL version read, and retried upon
+// concurrent ACL changes (see SetUpdateAttempts). It returns the nodes whose ACL was updated.
+func (zook *ZooKeeper) ReplaceACLIdentity(path string, oldScheme, oldId, newScheme, newId string, recursive bool) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	nodePaths, err := zook.nodePathsInternal(connection, path, recursive)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	updated := []string{}
+	for _, nodePath := range nodePaths {
+		for attempt := 1; ; attempt++ {
+			zook.throttle(1)
+			acl, stat, err := connection.GetACL(nodePath)
+			if err != nil {
+				return updated, wrapError(nodePath, err)
+			}
+			var replacedPerms int32
+			replaced := false
+			rewritten := []zk.ACL{}
+			for _, entry := range acl {
+				if entry.Scheme == oldScheme && entry.ID == oldId {
+					replacedPerms |= entry.Perms
+					replaced = true
+					continue
+				}
+				rewritten = append(rewritten, entry)
+			}
+			if !replaced {
+				break
+			}
+			merged := false
+			for i := range rewritten {
+				if rewritten[i].Scheme == newScheme && rewritten[i].ID == newId {
+					rewritten[i].Perms |= replacedPerms
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				rewritten = append(rewritten, zk.ACL{Scheme: newScheme, ID: newId, Perms: replacedPerms})
+			}
+			_, err = zook.setNodeACL(connection, nodePath, rewritten, stat.Aversion)
+			if err == nil {
+				updated = append(updated, nodePath)
+				break
+			}
+			if err != zk.ErrBadVersion || attempt >= zook.updateAttempts {
+				return updated, wrapError(nodePath, err)
+			}
+			log.Debugf("Concurrent ACL modification of %s, retrying", nodePath)
+		}
+	}
+	return updated, nil
+}
+
+// ACLChange describes the change of a node's ACL by SetACLRecursive. ACL entries are in the format getacl emits.
+type ACLChange struct {
+	Path    string
+	Current []string
+	New     []string
+	// RemovesOwnAdmin tells the new ACL revokes admin permission we currently have, locking us out of further
+	// ACL changes to the node
+	RemovesOwnAdmin bool
+}
+
+func (change ACLChange) String() string {
+	description := fmt.Sprintf("%s: %s -> %s", change.Path, strings.Join(change.Current, ","), strings.Join(change.New, ","))
+	if change.RemovesOwnAdmin {
+		description += " (removes own admin access)"
+	}
+	return description
+}
+
+// SetACLRecursive sets given ACL on given path and each of its descendants, top down, and returns the changes
+// made. Nodes whose ACL already equals the given one are skipped. Writes are conditional on the ACL version read.
+// With dryRun nothing is written, and the changes which would be made are returned; review those flagged as
+// removing our own admin access (see EffectiveAccess for how our access is determined) before applying.
+func (zook *ZooKeeper) SetACLRecursive(path string, aclstr string, dryRun bool) ([]ACLChange, error) {
+	acl, err := zook.parseACLString(aclstr)
+	if err != nil {
+		return nil, err
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	nodePaths, err := zook.nodePathsInternal(connection, path, true)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	identities := zook.authIdentities()
+	newACLStrings := zook.aclsToString(acl)
+	changes := []ACLChange{}
+	for _, nodePath := range nodePaths {
+		zook.throttle(1)
+		current, stat, err := connection.GetACL(nodePath)
+		if err != nil {
+			return changes, wrapError(nodePath, err)
+		}
+		if ACLEqual(current, acl) {
+			continue
+		}
+		change := ACLChange{
+			Path:            nodePath,
+			Current:         zook.aclsToString(current),
+			New:             newACLStrings,
+			RemovesOwnAdmin: aclGrants(current, identities, zk.PermAdmin) && !aclGrants(acl, identities, zk.PermAdmin),
+		}
+		if !dryRun {
+			if _, err := zook.setNodeACL(connection, nodePath, acl, stat.Aversion); err != nil {
+				return changes, wrapError(nodePath, err)
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"sync"
+	"time"
+)
+
+// cacheReconnectInterval is the time between attempts to reconnect a Cache whose session was lost
+const cacheReconnectInterval = time.Second
+
+// Cache keeps an in-memory copy of a node's data, kept up to date via a watch. It is safe for concurrent use.
+// Close it when done.
+type Cache struct {
+	zook   *ZooKeeper
+	path   string
+	mutex  sync.RWMutex
+	data   []byte
+	closed chan struct{}
+	done   chan struct{}
+
+	closeOnce sync.Once
+}
+
+// NewCache reads given path and returns a Cache of its data. The node need not exist: the cache then holds nil
+// until the node is created. Should the session be lost, the cache keeps serving the last data it read while
+// reconnecting in the background, then reads the node anew.
+func (zook *ZooKeeper) NewCache(path string) (*Cache, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	cache := &Cache{
+		zook:   zook,
+		path:   path,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	events, err := cache.refresh(connection)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	go cache.run(connection, events)
+	return cache, nil
+}
+
+// Get returns the cached data, or nil if the node does not exist. The returned slice must not be modified.
+func (cache *Cache) Get() []byte {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.data
+}
+
+// Close stops updating the cache and terminates its connection. Get keeps returning the last data read.
+// It may be called more than once.
+func (cache *Cache) Close() {
+	cache.closeOnce.Do(func() { close(cache.closed) })
+	<-cache.done
+}
+
+// refresh reads the node into the cache, arming a data watch, or an existence watch if the node does not exist
+func (cache *Cache) refresh(connection *zk.Conn) (<-chan zk.Event, error) {
+	for {
+		data, _, events, err := connection.GetW(cache.path)
+		if err == zk.ErrNoNode {
+			var exists bool
+			exists, _, events, err = connection.ExistsW(cache.path)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				// created in between
+				continue
+			}
+			data = nil
+		} else if err != nil {
+			return nil, err
+		}
+		cache.mutex.Lock()
+		cache.data = data
+		cache.mutex.Unlock()
+		return events, nil
+	}
+}
+
+// run refreshes the cache upon every watch notification, reconnecting when the session is lost, until closed
+func (cache *Cache) run(connection *zk.Conn, events <-chan zk.Event) {
+	defer close(cache.done)
+	for {
+		var event zk.Event
+		select {
+		case <-cache.closed:
+			connection.Close()
+			return
+		case event = <-events:
+		}
+		err := event.Err
+		if err == nil && event.Type != zk.EventNotWatching {
+			if events, err = cache.refresh(connection); err == nil {
+				continue
+			}
+		}
+		log.Warningf("Cache of %s lost its watch: %+v; reconnecting", cache.path, err)
+		connection.Close()
+		for {
+			select {
+			case <-cache.closed:
+				return
+			case <-time.After(cacheReconnectInterval):
+			}
+			if connection, err = cache.zook.connect(); err == nil {
+				if events, err = cache.refresh(connection); err == nil {
+					break
+				}
+				connection.Close()
+			}
+			log.Errorf("Cannot reconnect cache of %s: %+v", cache.path, err)
+		}
+	}
+}
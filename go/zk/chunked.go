@@ -0,0 +1,199 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"io"
+	gopath "path"
+	"strings"
+)
+
+// DefaultChunkSize is a chunk size for SetChunked well within ZooKeeper's default 1MB limit on node data
+const DefaultChunkSize = 512 * 1024
+
+// chunkPrefix prefixes the names of the children holding chunks
+const chunkPrefix = "chunk-"
+
+// chunkManifest is the data of a chunked node's parent, written once all chunks are, marking the set complete
+type chunkManifest struct {
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+	SHA1   string `json:"sha1"`
+}
+
+// chunkPath returns the path of the index'th chunk under given path
+func chunkPath(path string, index int) string {
+	return gopath.Join(path, fmt.Sprintf("%s%010d", chunkPrefix, index))
+}
+
+// SetChunked stores data which may exceed the limit on a single node's data: it splits data into chunks of at
+// most chunkSize bytes, stored in children of path named chunk-0000000000, chunk-0000000001 and so on, then
+// writes a manifest (chunk count, size and checksum) as the data of path, creating path as needed. The manifest is
+// cleared before, and written after, all chunks, so that GetChunked refuses a set which is being written or
+// whose writing failed. Children of path other than chunks are left alone.
+func (zook *ZooKeeper) SetChunked(path string, data []byte, chunkSize int) error {
+	if chunkSize < 1 {
+		return fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	if _, err := zook.setNode(connection, path, []byte{}, -1); err == zk.ErrNoNode {
+		if _, err := zook.createInternal(connection, path, []byte{}, zook.acl, true, zook.autoParentData); err != nil {
+			return wrapError(path, err)
+		}
+	} else if err != nil {
+		return wrapError(path, err)
+	}
+	zook.throttle(1)
+	children, _, err := connection.Children(path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	for _, child := range children {
+		if strings.HasPrefix(child, chunkPrefix) {
+			if err := zook.deleteNode(connection, gopath.Join(path, child), -1); err != nil && err != zk.ErrNoNode {
+				return wrapError(gopath.Join(path, child), err)
+			}
+		}
+	}
+
+	chunks := 0
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := zook.createNode(connection, chunkPath(path, chunks), data[offset:end], 0, zook.acl); err != nil {
+			return wrapError(chunkPath(path, chunks), err)
+		}
+		chunks++
+	}
+	checksum := sha1.Sum(data)
+	manifest, err := json.Marshal(chunkManifest{Chunks: chunks, Size: len(data), SHA1: hex.EncodeToString(checksum[:])})
+	if err != nil {
+		return err
+	}
+	_, err = zook.setNode(connection, path, manifest, -1)
+	return wrapError(path, err)
+}
+
+// parseChunkManifest returns the manifest held in given data, if it is one
+func parseChunkManifest(data []byte) (*chunkManifest, bool) {
+	manifest := &chunkManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil || manifest.SHA1 == "" {
+		return nil, false
+	}
+	return manifest, true
+}
+
+// writeChunks writes the chunks of given path to w, in order, one at a time, verifying them against the manifest
+func (zook *ZooKeeper) writeChunks(connection *zk.Conn, path string, manifest *chunkManifest, w io.Writer) error {
+	hash := sha1.New()
+	size := 0
+	for i := 0; i < manifest.Chunks; i++ {
+		zook.throttle(1)
+		chunk, _, err := connection.Get(chunkPath(path, i))
+		if err == zk.ErrNoNode {
+			return fmt.Errorf("%s: incomplete chunked data: missing chunk %d of %d", path, i, manifest.Chunks)
+		}
+		if err != nil {
+			return wrapError(chunkPath(path, i), err)
+		}
+		hash.Write(chunk)
+		size += len(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	if size != manifest.Size || hex.EncodeToString(hash.Sum(nil)) != manifest.SHA1 {
+		return errors.New(path + ": chunked data does not match its manifest; modified while read?")
+	}
+	return nil
+}
+
+// GetChunked returns the data stored by SetChunked at given path. It fails if the set of chunks is incomplete:
+// being written, or left behind by a failed SetChunked.
+func (zook *ZooKeeper) GetChunked(path string) ([]byte, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	zook.throttle(1)
+	manifestData, _, err := connection.Get(path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	if len(manifestData) == 0 {
+		return nil, fmt.Errorf("%s: incomplete chunked data", path)
+	}
+	manifest, ok := parseChunkManifest(manifestData)
+	if !ok {
+		return nil, fmt.Errorf("%s: not chunked data", path)
+	}
+	var data bytes.Buffer
+	if err := zook.writeChunks(connection, path, manifest, &data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// GetTo writes the data of given path to w: the data stored by SetChunked, if path holds chunks, streamed one
+// chunk at a time, or else the path's own data. Chunks are verified as a whole only once all were written, hence
+// w may have received data by the time GetTo fails.
+func (zook *ZooKeeper) GetTo(path string, w io.Writer) error {
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	zook.throttle(1)
+	data, stat, err := connection.Get(path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	if manifest, ok := parseChunkManifest(data); ok {
+		return zook.writeChunks(connection, path, manifest, w)
+	}
+	if len(data) == 0 && stat.NumChildren > 0 {
+		zook.throttle(1)
+		children, _, err := connection.Children(path)
+		if err != nil {
+			return wrapError(path, err)
+		}
+		for _, child := range children {
+			if strings.HasPrefix(child, chunkPrefix) {
+				return fmt.Errorf("%s: incomplete chunked data", path)
+			}
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
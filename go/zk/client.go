@@ -0,0 +1,313 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"github.com/samuel/go-zookeeper/zk"
+	"sort"
+	"sync"
+)
+
+// Client issues operations over a single, persistent connection, for callers issuing many operations, which
+// would otherwise pay for a connection each. ZooKeeper's methods of the same names each use a throwaway Client.
+// A Client is safe for concurrent use. Close it when done.
+type Client struct {
+	zook       *ZooKeeper
+	connection *zk.Conn
+	events     <-chan zk.Event
+}
+
+// NewClient connects to given servers, with default settings
+func NewClient(servers []string) (*Client, error) {
+	zook := NewZooKeeper()
+	zook.SetServers(servers)
+	return zook.NewClient()
+}
+
+// NewClient connects, returning a client with this ZooKeeper's settings: servers, auth, ACL, audit and so on
+func (zook *ZooKeeper) NewClient() (*Client, error) {
+	connection, events, err := zook.connectWithEvents()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{zook: zook, connection: connection, events: events}, nil
+}
+
+// Events returns the channel of the client's session events, e.g. zk.StateHasSession once connected, and
+// zk.StateExpired should the session expire, upon which ephemeral nodes and watches of the client are gone. The
+// channel buffers but a few events, and drops further ones until consumed; it is closed once the client is.
+// Session state changes are logged regardless.
+func (client *Client) Events() <-chan zk.Event {
+	return client.events
+}
+
+// Close terminates the client's connection, and with it the client's session
+func (client *Client) Close() {
+	client.connection.Close()
+}
+
+// Exists returns true when the given path exists
+func (client *Client) Exists(path string) (bool, error) {
+	var exists bool
+	err := client.zook.retry(func() (err error) {
+		exists, _, err = client.connection.Exists(path)
+		return err
+	})
+	return exists, wrapError(path, err)
+}
+
+// Get returns value associated with given path, or error if path does not exist
+func (client *Client) Get(path string) ([]byte, error) {
+	data, _, err := client.GetWithStat(path)
+	return data, err
+}
+
+// Sync has the server this client is connected to catch up with the leader on given path, so that reads
+// following it on this client observe all writes committed before it
+func (client *Client) Sync(path string) error {
+	err := client.zook.retry(func() (err error) {
+		_, err = client.connection.Sync(path)
+		return err
+	})
+	return wrapError(path, err)
+}
+
+// GetAfterSync syncs given path, then returns its value, up to date as of the call, or error if path does not exist
+func (client *Client) GetAfterSync(path string) ([]byte, error) {
+	if err := client.Sync(path); err != nil {
+		return nil, err
+	}
+	return client.Get(path)
+}
+
+// Stat returns the metadata of given path, or an error of kind ErrNotFound if path does not exist
+func (client *Client) Stat(path string) (*zk.Stat, error) {
+	var exists bool
+	var stat *zk.Stat
+	err := client.zook.retry(func() (err error) {
+		exists, stat, err = client.connection.Exists(path)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	return stat, nil
+}
+
+// GetWithStat returns value associated with given path along with its metadata, read in one request
+func (client *Client) GetWithStat(path string) ([]byte, *zk.Stat, error) {
+	var data []byte
+	var stat *zk.Stat
+	err := client.zook.retry(func() (err error) {
+		data, stat, err = client.connection.Get(path)
+		return err
+	})
+	if err != nil {
+		return nil, nil, wrapError(path, err)
+	}
+	return data, stat, nil
+}
+
+// Children returns sub-paths of given path, optionally empty array, or error if path does not exist
+func (client *Client) Children(path string) ([]string, error) {
+	var children []string
+	err := client.zook.retry(func() (err error) {
+		children, _, err = client.connection.Children(path)
+		return err
+	})
+	return children, wrapError(path, err)
+}
+
+// CreateWithFlags creates a new path, returning the created path, which for a sequential node carries the
+// sequence number the server appended. flags combine zk.FlagEphemeral and zk.FlagSequence. aclstr defaults to
+// the ZooKeeper's ACL when empty. Parent directories are not created.
+func (client *Client) CreateWithFlags(path string, data []byte, aclstr string, flags int32) (string, error) {
+	acl := client.zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = client.zook.parseACLString(aclstr); err != nil {
+			return "", err
+		}
+	}
+	created, err := client.zook.createNode(client.connection, path, data, flags, acl)
+	return created, wrapError(path, err)
+}
+
+// CreateEphemeral creates a new path which exists for as long as the client's session does: it is deleted by
+// the server once the client is closed, or its session expires.
+func (client *Client) CreateEphemeral(path string, data []byte, aclstr string) (string, error) {
+	return client.CreateWithFlags(path, data, aclstr, zk.FlagEphemeral)
+}
+
+// CreateSequential creates a new path named path followed by a server assigned, zero padded sequence number,
+// and returns the created path.
+func (client *Client) CreateSequential(path string, data []byte, aclstr string) (string, error) {
+	return client.CreateWithFlags(path, data, aclstr, zk.FlagSequence)
+}
+
+// CreateProtectedEphemeralSequential creates an ephemeral sequential node, as the recipes of locks and leader
+// election do, safely retrying should the connection be lost while creating: the node's name is prefixed with
+// _c_ and a random GUID, e.g. /locks/lock- becomes /locks/_c_<32 hex digits>-lock-0000000001, by which a node
+// created by a lost request is found again rather than leaked. Returns the path of the created node.
+func (client *Client) CreateProtectedEphemeralSequential(path string, data []byte, aclstr string) (string, error) {
+	acl := client.zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = client.zook.parseACLString(aclstr); err != nil {
+			return "", err
+		}
+	}
+	// Not retried as other requests are (see SetRetryPolicy): the client library retries on its own, looking for
+	// the node by its GUID, while a new request would create another node under another GUID
+	client.zook.throttle(1)
+	created, err := client.connection.CreateProtectedEphemeralSequential(path, data, acl)
+	client.zook.audit("create", path, err)
+	return created, wrapError(path, err)
+}
+
+// Set updates a value for a given path, or returns with error if the path does not exist
+func (client *Client) Set(path string, data []byte) (*zk.Stat, error) {
+	return client.SetWithVersion(path, data, -1)
+}
+
+// SetWithVersion updates a value for a given path only if its version is given version, returning
+// an error of kind ErrBadVersion otherwise. A version of -1 matches any version.
+func (client *Client) SetWithVersion(path string, data []byte, version int32) (*zk.Stat, error) {
+	stat, err := client.zook.setNode(client.connection, path, data, version)
+	return stat, wrapError(path, err)
+}
+
+// Delete removes a path entry. It returns with error if the path does not exist, or has subdirectories, or is
+// the root, which cannot be deleted.
+func (client *Client) Delete(path string) error {
+	if path == "/" {
+		return errDeleteRoot
+	}
+	return wrapError(path, client.zook.deleteNode(client.connection, path, -1))
+}
+
+// WatchData returns a channel delivering the changes of given path as they happen, as data watch notifications:
+// zk.EventNodeDataChanged, zk.EventNodeDeleted, and zk.EventNodeCreated should the path be created, whether or not
+// it exists at first. Changes in between two notifications are coalesced by ZooKeeper. The channel is closed when
+// stop is closed, or after delivering an event with Type zk.EventNotWatching or a non nil Err, e.g. once the
+// session is lost or the client is closed. The events must be consumed for watching to go on.
+func (client *Client) WatchData(path string, stop <-chan struct{}) (<-chan zk.Event, error) {
+	events, err := client.watchData(path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	result := make(chan zk.Event)
+	go func() {
+		defer close(result)
+		for {
+			var event zk.Event
+			select {
+			case <-stop:
+				return
+			case event = <-events:
+			}
+			if event.Err == nil && event.Type != zk.EventNotWatching {
+				if events, err = client.watchData(path); err != nil {
+					event = zk.Event{Type: zk.EventNotWatching, State: event.State, Path: path, Err: err}
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case result <- event:
+			}
+			if event.Err != nil || event.Type == zk.EventNotWatching {
+				return
+			}
+		}
+	}()
+	return result, nil
+}
+
+// watchData arms a data watch on given path, or an existence watch if the path does not exist
+func (client *Client) watchData(path string) (<-chan zk.Event, error) {
+	_, _, events, err := client.connection.GetW(path)
+	if err == zk.ErrNoNode {
+		_, _, events, err = client.connection.ExistsW(path)
+	}
+	return events, err
+}
+
+// ChildrenWatch delivers the children of a path as they change; see Client.WatchChildren
+type ChildrenWatch struct {
+	// C delivers sorted children lists, and is closed when the watch ends
+	C <-chan []string
+
+	mutex sync.Mutex
+	err   error
+}
+
+// Err returns the reason the watch ended once C is closed: an error of kind ErrNotFound when the path was deleted, another error
+// when the session was lost or the client closed, and nil when stopped.
+func (watch *ChildrenWatch) Err() error {
+	watch.mutex.Lock()
+	defer watch.mutex.Unlock()
+	return watch.err
+}
+
+// WatchChildren watches the children of given path, delivering on the returned watch's C the current children,
+// then the children anew after every change, until stop is closed or the watch fails; see ChildrenWatch.Err.
+// Lists are delivered in the order the changes happened, but changes in between two notifications are coalesced
+// by ZooKeeper, as are changes while the previous list awaits consumption: a child added and removed in quick
+// succession may never be listed. The lists must be consumed for watching to go on.
+func (client *Client) WatchChildren(path string, stop <-chan struct{}) (*ChildrenWatch, error) {
+	children, _, events, err := client.connection.ChildrenW(path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	result := make(chan []string)
+	watch := &ChildrenWatch{C: result}
+	go func() {
+		defer close(result)
+		for {
+			sort.Strings(children)
+			select {
+			case <-stop:
+				return
+			case result <- children:
+			}
+			var event zk.Event
+			select {
+			case <-stop:
+				return
+			case event = <-events:
+			}
+			err := event.Err
+			if err == nil && event.Type == zk.EventNotWatching {
+				err = zk.ErrConnectionClosed
+			}
+			if err == nil {
+				children, _, events, err = client.connection.ChildrenW(path)
+			}
+			if err != nil {
+				watch.mutex.Lock()
+				watch.err = wrapError(path, err)
+				watch.mutex.Unlock()
+				return
+			}
+		}
+	}()
+	return watch, nil
+}
@@ -0,0 +1,486 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	gopath "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnectionReport describes the session parameters in effect for a connection
+type ConnectionReport struct {
+	RequestedTimeout time.Duration
+	// NegotiatedTimeout is the session timeout granted by the server, or 0 when it could not be determined
+	NegotiatedTimeout time.Duration
+	Server            string
+	SessionID         int64
+	// ReadOnly tells the server is in read-only mode, having lost contact with the quorum, as its "srvr" reports
+	ReadOnly bool
+}
+
+// ConnectAndReport connects and reports the session parameters in effect. The client library does not expose
+// the negotiated session timeout, hence it is read off the server's "cons" four letter word, which requires
+// "cons" to be whitelisted on the server (4lw.commands.whitelist). Whether the server is read-only is likewise read
+// off "srvr". Both are asked over the same proxy and TLS settings as the session.
+func (zook *ZooKeeper) ConnectAndReport() (ConnectionReport, error) {
+	report := ConnectionReport{RequestedTimeout: zook.sessionTimeout}
+	connection, err := zook.connect()
+	if err != nil {
+		return report, err
+	}
+	defer connection.Close()
+
+	// The session is only established upon the first request
+	if _, _, err := connection.Exists("/"); err != nil {
+		return report, err
+	}
+	report.Server = connection.Server()
+	report.SessionID = connection.SessionID()
+
+	if report.NegotiatedTimeout, err = negotiatedTimeout(zook.dial, report.Server, report.SessionID, zook.sessionTimeout); err != nil {
+		log.Warningf("Cannot determine negotiated session timeout via cons on %s: %+v", report.Server, err)
+	}
+	if mode, err := serverMode(zook.dial, report.Server, zook.sessionTimeout); err != nil {
+		log.Warningf("Cannot determine server mode via srvr on %s: %+v", report.Server, err)
+	} else {
+		report.ReadOnly = mode == "read-only"
+	}
+	return report, nil
+}
+
+// serverAddress returns given server as host:port, adding the default port if missing
+func serverAddress(server string) string {
+	if !strings.Contains(server, ":") {
+		return server + ":" + strconv.Itoa(zk.DefaultPort)
+	}
+	return server
+}
+
+// ProbeServers attempts a TCP connection to each of the servers, concurrently, and splits them into
+// those which accept the connection within the session timeout and those which do not.
+func (zook *ZooKeeper) ProbeServers() (reachable []string, unreachable []string) {
+	servers := zook.getServers()
+	responsive := make([]bool, len(servers))
+	forEachConcurrently(len(servers), func(i int) {
+		address := serverAddress(servers[i])
+		conn, err := zook.dial("tcp", address, zook.sessionTimeout)
+		if err != nil {
+			log.Debugf("Probing %s: %+v", address, err)
+			return
+		}
+		conn.Close()
+		responsive[i] = true
+	})
+	for i, server := range servers {
+		if responsive[i] {
+			reachable = append(reachable, server)
+		} else {
+			unreachable = append(unreachable, server)
+		}
+	}
+	return reachable, unreachable
+}
+
+// RoundTripLatency measures the time it takes for a write to become visible to a read: it writes the current
+// time to given path (creating it if needed), optionally syncs, and reads it back. Session establishment is
+// not part of the measurement. A node created by the probe is deleted afterwards; given path should be a
+// dedicated probe path, never one holding real data.
+func (zook *ZooKeeper) RoundTripLatency(path string, sync bool) (time.Duration, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	if _, _, err := connection.Exists("/"); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	data := []byte(start.UTC().Format(time.RFC3339Nano))
+	created := true
+	if _, err := zook.createNode(connection, path, data, 0, zook.acl); err == zk.ErrNodeExists {
+		created = false
+		if _, err := zook.setNode(connection, path, data, -1); err != nil {
+			return 0, wrapError(path, err)
+		}
+	} else if err != nil {
+		return 0, wrapError(path, err)
+	}
+	if sync {
+		if _, err := connection.Sync(path); err != nil {
+			return 0, wrapError(path, err)
+		}
+	}
+	readData, _, err := connection.Get(path)
+	latency := time.Since(start)
+	if created {
+		if deleteErr := zook.deleteNode(connection, path, -1); deleteErr != nil {
+			log.Errorf("Cannot clean up probe path %s: %+v", path, deleteErr)
+		}
+	}
+	if err != nil {
+		return 0, wrapError(path, err)
+	}
+	if !bytes.Equal(readData, data) {
+		return 0, fmt.Errorf("read back %q from %s, expected %q; is the probe path used concurrently?", readData, path, data)
+	}
+	return latency, nil
+}
+
+var serverModeRegexp = regexp.MustCompile(`(?m)^Mode: ([\w-]+)`)
+
+// consSessionRegexp matches the session id and timeout of a connection listed by "cons"
+var consSessionRegexp = regexp.MustCompile(`sid=0x([0-9a-f]+)[^)]*\bto=(\d+)`)
+
+// fourLetterWord sends given four letter word command to given server and returns the response
+func fourLetterWord(dial zk.Dialer, address string, command string, timeout time.Duration) ([]byte, error) {
+	conn, err := dial("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(conn)
+}
+
+// serverMode returns the mode a server reports via "srvr": leader, follower, observer, standalone or read-only
+func serverMode(dial zk.Dialer, address string, timeout time.Duration) (string, error) {
+	response, err := fourLetterWord(dial, address, "srvr", timeout)
+	if err != nil {
+		return "", err
+	}
+	match := serverModeRegexp.FindSubmatch(response)
+	if match == nil {
+		return "", fmt.Errorf("unexpected srvr response from %s: %q", address, bytes.TrimSpace(response))
+	}
+	return string(match[1]), nil
+}
+
+// negotiatedTimeout returns the timeout of given session, as listed by the "cons" of the server it is connected to
+func negotiatedTimeout(dial zk.Dialer, address string, sessionID int64, timeout time.Duration) (time.Duration, error) {
+	response, err := fourLetterWord(dial, address, "cons", timeout)
+	if err != nil {
+		return 0, err
+	}
+	for _, match := range consSessionRegexp.FindAllSubmatch(response, -1) {
+		sid, err := strconv.ParseUint(string(match[1]), 16, 64)
+		if err != nil || int64(sid) != sessionID {
+			continue
+		}
+		millis, err := strconv.Atoi(string(match[2]))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(millis) * time.Millisecond, nil
+	}
+	return 0, fmt.Errorf("session 0x%x not listed by cons on %s", sessionID, address)
+}
+
+// HasQuorum tells whether the ensemble currently has quorum: a leader, and a majority of the voting servers
+// serving as leader or followers. Each configured server is asked for its mode via the "srvr" four letter word,
+// which must be whitelisted on the servers (4lw.commands.whitelist). Observers do not vote, and are excluded
+// from the count. A server which does not respond cannot be told apart from a voter, and counts as a voter
+// which is down. A single standalone server is a quorum of its own. An error is returned only when no
+// server responds.
+func (zook *ZooKeeper) HasQuorum() (bool, error) {
+	servers := zook.getServers()
+	modes := make([]string, len(servers))
+	errs := make([]error, len(servers))
+	forEachConcurrently(len(servers), func(i int) {
+		modes[i], errs[i] = serverMode(zook.dial, serverAddress(servers[i]), zook.sessionTimeout)
+	})
+	voters, up, leaders, responded := 0, 0, 0, 0
+	for i, server := range servers {
+		if errs[i] != nil {
+			log.Debugf("Querying mode of %s: %+v", server, errs[i])
+			voters++
+			continue
+		}
+		responded++
+		log.Debugf("%s is %s", server, modes[i])
+		switch modes[i] {
+		case "observer":
+		case "standalone":
+			if len(servers) == 1 {
+				return true, nil
+			}
+			voters++
+		case "leader":
+			leaders++
+			voters++
+			up++
+		case "follower":
+			voters++
+			up++
+		default:
+			voters++
+		}
+	}
+	if responded == 0 {
+		return false, fmt.Errorf("none of %d servers responded to srvr", len(servers))
+	}
+	return leaders == 1 && up > voters/2, nil
+}
+
+// WalkStats summarizes the Children calls of a recursive listing, telling a slow server or network (high
+// latencies) apart from a large tree (many calls)
+type WalkStats struct {
+	Calls int
+	Total time.Duration
+	Min   time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func (stats WalkStats) String() string {
+	return fmt.Sprintf("calls: %d, total: %s, min: %s, p50: %s, p99: %s, max: %s",
+		stats.Calls, stats.Total, stats.Min, stats.P50, stats.P99, stats.Max)
+}
+
+// newWalkStats summarizes given call latencies
+func newWalkStats(latencies []time.Duration) WalkStats {
+	stats := WalkStats{Calls: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, latency := range sorted {
+		stats.Total += latency
+	}
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	stats.Min, stats.P50, stats.P99, stats.Max = sorted[0], percentile(50), percentile(99), sorted[len(sorted)-1]
+	return stats
+}
+
+// ChildrenRecursiveWithStats is ChildrenRecursive, also returning the latency distribution of the Children
+// calls it made, one per node of the tree
+func (zook *ZooKeeper) ChildrenRecursiveWithStats(path string) ([]string, WalkStats, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return []string{}, WalkStats{}, err
+	}
+	defer connection.Close()
+
+	latencies := []time.Duration{}
+	result, err := zook.childrenRecursiveTimed(connection, path, "", func(latency time.Duration) {
+		latencies = append(latencies, latency)
+	})
+	return result, newWalkStats(latencies), wrapError(path, err)
+}
+
+// maxFanoutInternal: walks given path and its descendants depth first, returning the node with most children.
+// Nodes are listed only when their stat shows they have children; the stats of siblings are read concurrently.
+func (zook *ZooKeeper) maxFanoutInternal(connection *zk.Conn, path string, stat *zk.Stat) (string, int32, error) {
+	if stat.NumChildren == 0 {
+		return path, 0, nil
+	}
+	zook.throttle(1)
+	children, stat, err := connection.Children(path)
+	if err == zk.ErrNoNode {
+		// deleted since listed by its parent
+		return "", -1, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	stats := make([]*zk.Stat, len(children))
+	errs := make([]error, len(children))
+	forEachConcurrently(len(children), func(i int) {
+		zook.throttle(1)
+		var exists bool
+		if exists, stats[i], errs[i] = connection.Exists(gopath.Join(path, children[i])); errs[i] == nil && !exists {
+			// deleted since listed
+			stats[i] = nil
+		}
+	})
+	widest, count := path, stat.NumChildren
+	for i, child := range children {
+		if errs[i] != nil {
+			return "", 0, errs[i]
+		}
+		if stats[i] == nil {
+			continue
+		}
+		childWidest, childCount, err := zook.maxFanoutInternal(connection, gopath.Join(path, child), stats[i])
+		if err != nil {
+			return "", 0, err
+		}
+		if childCount > count {
+			widest, count = childWidest, childCount
+		}
+	}
+	return widest, count, nil
+}
+
+// MaxFanout returns the node with most children under given path, inclusive, and its number of children.
+// ZooKeeper performs poorly with very wide parents. The walk is depth first, holding only the children names
+// of the nodes along the current branch, and skips listing leaves.
+func (zook *ZooKeeper) MaxFanout(path string) (widest string, count int32, err error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return "", 0, err
+	}
+	defer connection.Close()
+
+	exists, stat, err := connection.Exists(path)
+	if err != nil {
+		return "", 0, wrapError(path, err)
+	} else if !exists {
+		return "", 0, wrapError(path, zk.ErrNoNode)
+	}
+	widest, count, err = zook.maxFanoutInternal(connection, path, stat)
+	return widest, count, wrapError(path, err)
+}
+
+// maxNodeDataLength is ZooKeeper's default limit on a node's data (jute.maxbuffer), of 1MB
+const maxNodeDataLength = 1024 * 1024
+
+// SubtreeStats returns the number of nodes under given path, inclusive, their total data length, and the depth of
+// the deepest of them relative to path (0 for path alone). Nodes whose data reaches 90% of ZooKeeper's default
+// 1MB limit on node data are logged as warnings. The walk lists the subtree, then reads the metadata of each node,
+// over a single connection. Nodes deleted in between are not counted.
+func (zook *ZooKeeper) SubtreeStats(path string) (nodeCount int, totalBytes int64, maxDepth int, err error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer connection.Close()
+
+	err = zook.walkStatsInternal(connection, path, func(relativePath string, stat *zk.Stat) {
+		nodeCount++
+		totalBytes += int64(stat.DataLength)
+		if stat.DataLength >= maxNodeDataLength*9/10 {
+			log.Warningf("%s holds %d bytes, approaching the %d bytes limit", gopath.Join(path, relativePath), stat.DataLength, maxNodeDataLength)
+		}
+		if relativePath != "" {
+			if depth := strings.Count(relativePath, "/") + 1; depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+	})
+	return nodeCount, totalBytes, maxDepth, err
+}
+
+// walkStatsInternal lists given path and its descendants, then reads the metadata of each, passing it to visit
+// along with the node's path relative to given path. Nodes deleted in between are skipped.
+func (zook *ZooKeeper) walkStatsInternal(connection *zk.Conn, path string, visit func(relativePath string, stat *zk.Stat)) error {
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return wrapError(path, err)
+	}
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		exists, stat, err := connection.Exists(nodePath)
+		if err != nil {
+			return wrapError(nodePath, err)
+		}
+		if exists {
+			visit(relativePath, stat)
+		}
+	}
+	return nil
+}
+
+// NodeCreation identifies a node along with when it was created
+type NodeCreation struct {
+	Path    string
+	Created time.Time
+	Czxid   int64
+}
+
+// oldestNodesInternal: walks given path and its descendants depth first, keeping in oldest the n nodes of
+// smallest czxid, sorted oldest first
+func (zook *ZooKeeper) oldestNodesInternal(connection *zk.Conn, path string, n int, oldest *[]NodeCreation) error {
+	zook.throttle(1)
+	children, stat, err := connection.Children(path)
+	if err == zk.ErrNoNode {
+		// deleted since listed by its parent
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(*oldest) < n || stat.Czxid < (*oldest)[len(*oldest)-1].Czxid {
+		node := NodeCreation{Path: path, Created: time.Unix(0, stat.Ctime*int64(time.Millisecond)), Czxid: stat.Czxid}
+		i := sort.Search(len(*oldest), func(i int) bool { return (*oldest)[i].Czxid > stat.Czxid })
+		*oldest = append((*oldest)[:i], append([]NodeCreation{node}, (*oldest)[i:]...)...)
+		if len(*oldest) > n {
+			*oldest = (*oldest)[:n]
+		}
+	}
+	for _, child := range children {
+		if err := zook.oldestNodesInternal(connection, gopath.Join(path, child), n, oldest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OldestNodes returns the n earliest created nodes under given path, inclusive, oldest first. Creation order is
+// by czxid, which unlike ctime does not depend on the servers' clocks. The walk is depth first, holding only the
+// n oldest nodes found so far and the children names of the nodes along the current branch.
+func (zook *ZooKeeper) OldestNodes(path string, n int) ([]NodeCreation, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of nodes: %d", n)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	if exists, _, err := connection.Exists(path); err != nil {
+		return nil, wrapError(path, err)
+	} else if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	oldest := []NodeCreation{}
+	err = zook.oldestNodesInternal(connection, path, n, &oldest)
+	return oldest, wrapError(path, err)
+}
+
+// OldestNode returns the earliest created node under given path, inclusive, and its creation time. See OldestNodes.
+func (zook *ZooKeeper) OldestNode(path string) (oldestPath string, created time.Time, err error) {
+	oldest, err := zook.OldestNodes(path, 1)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if len(oldest) == 0 {
+		// path was deleted while walked
+		return "", time.Time{}, wrapError(path, zk.ErrNoNode)
+	}
+	return oldest[0].Path, oldest[0].Created, nil
+}
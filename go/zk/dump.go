@@ -0,0 +1,122 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+)
+
+// NodeMeta is the content of the .meta.json sidecar DumpNode writes along with a node's data. ACL entries
+// are in the format getacl emits.
+type NodeMeta struct {
+	Path string   `json:"path"`
+	ACL  []string `json:"acl"`
+	Stat zk.Stat  `json:"stat"`
+}
+
+// dumpFiles returns the data and metadata file names of a dump named name in dir
+func dumpFiles(dir string, name string) (dataFile string, metaFile string) {
+	return filepath.Join(dir, name+".data"), filepath.Join(dir, name+".meta.json")
+}
+
+// DumpNode saves a single node for offline inspection: its data, byte for byte, to dir/<name>.data, and its
+// path, ACL and stat to dir/<name>.meta.json, where name is the last element of path. dir is created as needed.
+func (zook *ZooKeeper) DumpNode(path string, dir string) error {
+	name := gopath.Base(path)
+	if name == "/" {
+		return errors.New("cannot dump the root node")
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	data, stat, err := connection.Get(path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	acl, _, err := connection.GetACL(path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	meta, err := json.MarshalIndent(NodeMeta{Path: path, ACL: zook.aclsToString(acl), Stat: *stat}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dataFile, metaFile := dumpFiles(dir, name)
+	if err := ioutil.WriteFile(dataFile, data, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaFile, meta, 0644)
+}
+
+// UndumpNode restores a node saved by DumpNode under given name in dir, creating it at path with the saved data
+// and ACL. With force, missing parents are created. The node is created persistent, even if it was dumped as
+// an ephemeral. It fails if path exists, or if the data file disagrees with the data length in the metadata.
+func (zook *ZooKeeper) UndumpNode(path string, dir string, name string, force bool) error {
+	dataFile, metaFile := dumpFiles(dir, name)
+	data, err := ioutil.ReadFile(dataFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("missing dump data file %s", dataFile)
+	}
+	if err != nil {
+		return err
+	}
+	metaContent, err := ioutil.ReadFile(metaFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("missing dump metadata file %s", metaFile)
+	}
+	if err != nil {
+		return err
+	}
+	meta := NodeMeta{}
+	if err := json.Unmarshal(metaContent, &meta); err != nil {
+		return fmt.Errorf("cannot parse dump metadata file %s: %+v", metaFile, err)
+	}
+	if int(meta.Stat.DataLength) != len(data) {
+		return fmt.Errorf("%s holds %d bytes but %s says %d; are they of the same dump?", dataFile, len(data), metaFile, meta.Stat.DataLength)
+	}
+	if len(meta.ACL) == 0 {
+		return fmt.Errorf("no ACL in dump metadata file %s", metaFile)
+	}
+	acl, err := zook.parseACLString(strings.Join(meta.ACL, ","))
+	if err != nil {
+		return fmt.Errorf("invalid ACL in dump metadata file %s: %+v", metaFile, err)
+	}
+
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	_, err = zook.createInternalWithACL(connection, path, data, force, acl, zook.autoParentData)
+	return wrapError(path, err)
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+)
+
+// ephemeralsOwnedByInternal: walks given path and its descendants, collecting ephemeral nodes owned by given session
+func (zook *ZooKeeper) ephemeralsOwnedByInternal(connection *zk.Conn, path string, sessionID int64) ([]string, error) {
+	result := []string{}
+	zook.throttle(1)
+	exists, stat, err := connection.Exists(path)
+	if err != nil || !exists {
+		return result, err
+	}
+	if stat.EphemeralOwner == sessionID {
+		result = append(result, path)
+	}
+	if stat.NumChildren == 0 {
+		return result, nil
+	}
+	zook.throttle(1)
+	children, _, err := connection.Children(path)
+	if err != nil {
+		return result, err
+	}
+	for _, child := range children {
+		childResult, err := zook.ephemeralsOwnedByInternal(connection, gopath.Join(path, child), sessionID)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, childResult...)
+	}
+	return result, nil
+}
+
+// EphemeralsOwnedBy returns the ephemeral nodes under given prefix (inclusive) owned by given session id
+func (zook *ZooKeeper) EphemeralsOwnedBy(prefix string, sessionID int64) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	result, err := zook.ephemeralsOwnedByInternal(connection, prefix, sessionID)
+	return result, wrapError(prefix, err)
+}
+
+// MyEphemerals returns the ephemeral nodes under given prefix (inclusive) owned by the client's session.
+// ZooKeeper 3.6 offers a server side getEphemerals for this; the go-zookeeper client we build with
+// does not support that request, hence the tree is walked client side, matching the session id.
+func (client *Client) MyEphemerals(prefix string) ([]string, error) {
+	// The session id is only known once the session is established
+	if _, err := client.Exists(prefix); err != nil {
+		return nil, err
+	}
+	result, err := client.zook.ephemeralsOwnedByInternal(client.connection, prefix, client.connection.SessionID())
+	return result, wrapError(prefix, err)
+}
+
+// IsEphemeral returns whether given path is an ephemeral node, along with the id of the session owning it, which
+// is 0 for a persistent node. The session of a client holding a lock is thus told by the lock's node.
+func (zook *ZooKeeper) IsEphemeral(path string) (bool, int64, error) {
+	stat, err := zook.Stat(path)
+	if err != nil {
+		return false, 0, err
+	}
+	return stat.EphemeralOwner != 0, stat.EphemeralOwner, nil
+}
+
+// EphemeralCounts returns the number of ephemeral nodes under given path, inclusive, per owning session id, e.g.
+// to spot a session leaking ephemerals. The walk is that of SubtreeStats.
+func (zook *ZooKeeper) EphemeralCounts(path string) (map[int64]int, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	counts := make(map[int64]int)
+	err = zook.walkStatsInternal(connection, path, func(relativePath string, stat *zk.Stat) {
+		if stat.EphemeralOwner != 0 {
+			counts[stat.EphemeralOwner]++
+		}
+	})
+	return counts, wrapError(path, err)
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"errors"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Kinds of node operation failures, matched by *Error
+var (
+	ErrNotFound         = errors.New("node does not exist")
+	ErrNodeExists       = errors.New("node already exists")
+	ErrNotAuthenticated = errors.New("not authenticated")
+	ErrBadVersion       = errors.New("version conflict")
+	ErrNotEmpty         = errors.New("node has children")
+)
+
+// errDeleteRoot is returned upon attempts to delete the root node, which ZooKeeper forbids
+var errDeleteRoot = errors.New("cannot delete the root node /; delete its children instead")
+
+// errorKinds maps the client library's errors onto our kinds of failures
+var errorKinds = map[error]error{
+	zk.ErrNoNode:     ErrNotFound,
+	zk.ErrNodeExists: ErrNodeExists,
+	zk.ErrNoAuth:     ErrNotAuthenticated,
+	zk.ErrBadVersion: ErrBadVersion,
+	zk.ErrNotEmpty:   ErrNotEmpty,
+}
+
+// Error is returned by node operations failing for reasons callers commonly handle: a missing node, an existing
+// node, missing permissions, a version conflict or a node having children. errors.Is matches it against the
+// corresponding kind, e.g. ErrNotFound, as well as against the client library's error it wraps, e.g. zk.ErrNoNode.
+// Other failures are returned as the client library reports them.
+type Error struct {
+	// Path is the path of the node the operation failed on
+	Path string
+	// Err is the client library's error
+	Err error
+
+	kind error
+}
+
+// Error returns the client library's message, as the error would read unwrapped
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the client library's error
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Is returns true when target is the kind of failure, e.g. ErrNotFound
+func (err *Error) Is(target error) bool {
+	return target == err.kind
+}
+
+// wrapError returns given client library error as an *Error when it is of a known kind, and as is otherwise.
+// Errors are compared rather than looked up, as some, e.g. MultiError, cannot be map keys.
+func wrapError(path string, err error) error {
+	for libErr, kind := range errorKinds {
+		if err == libErr {
+			return &Error{Path: path, Err: err, kind: kind}
+		}
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+	"sort"
+	"strings"
+)
+
+// Export is a point in time backup of a subtree: the subtree's root path, and all of its nodes.
+// Its JSON encoding is the export document format.
+type Export struct {
+	Root  string         `json:"root"`
+	Nodes []ExportedNode `json:"nodes"`
+}
+
+// ExportedNode is a single node of an Export. Path is absolute. ACL entries are in the format getacl emits.
+// Data is encoded as base64, as JSON does for []byte, so that arbitrary binary data, which need not be valid
+// UTF-8, survives the export as is.
+type ExportedNode struct {
+	Path string   `json:"path"`
+	Data []byte   `json:"data"`
+	ACL  []string `json:"acl"`
+}
+
+// encodeExport encodes an export document
+func encodeExport(export *Export) ([]byte, error) {
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// parseExport decodes an export document
+func parseExport(jsonData []byte) (*Export, error) {
+	export := &Export{}
+	if err := json.Unmarshal(jsonData, export); err != nil {
+		return nil, fmt.Errorf("cannot parse export document: %+v", err)
+	}
+	return export, nil
+}
+
+// DiffType is the kind of difference a DiffEntry describes
+type DiffType string
+
+const (
+	DiffAdded   DiffType = "added"
+	DiffRemoved DiffType = "removed"
+	DiffChanged DiffType = "changed"
+)
+
+// DiffEntry is a single path which differs between two subtrees. Detail lists what changed for DiffChanged.
+type DiffEntry struct {
+	Path   string
+	Type   DiffType
+	Detail string
+}
+
+func (entry DiffEntry) String() string {
+	if entry.Detail == "" {
+		return fmt.Sprintf("%s %s", entry.Type, entry.Path)
+	}
+	return fmt.Sprintf("%s %s (%s)", entry.Type, entry.Path, entry.Detail)
+}
+
+// aclStringsEqual compares ACLs in getacl format, regardless of order
+func (zook *ZooKeeper) aclStringsEqual(a, b []string) bool {
+	aACL, aErr := zook.parseACLString(strings.Join(a, ","))
+	bACL, bErr := zook.parseACLString(strings.Join(b, ","))
+	if aErr != nil || bErr != nil || len(a) == 0 || len(b) == 0 {
+		return strings.Join(a, ",") == strings.Join(b, ",")
+	}
+	return ACLEqual(aACL, bACL)
+}
+
+// diffExports returns the paths added, removed or changed (in data or ACL) from a to b, sorted by path
+func (zook *ZooKeeper) diffExports(a, b *Export) []DiffEntry {
+	aNodes := make(map[string]ExportedNode)
+	for _, node := range a.Nodes {
+		aNodes[node.Path] = node
+	}
+	bNodes := make(map[string]ExportedNode)
+	for _, node := range b.Nodes {
+		bNodes[node.Path] = node
+	}
+	entries := []DiffEntry{}
+	for path, aNode := range aNodes {
+		bNode, ok := bNodes[path]
+		if !ok {
+			entries = append(entries, DiffEntry{Path: path, Type: DiffRemoved})
+			continue
+		}
+		changes := []string{}
+		if !bytes.Equal(aNode.Data, bNode.Data) {
+			changes = append(changes, "data")
+		}
+		if !zook.aclStringsEqual(aNode.ACL, bNode.ACL) {
+			changes = append(changes, "acl")
+		}
+		if len(changes) > 0 {
+			entries = append(entries, DiffEntry{Path: path, Type: DiffChanged, Detail: strings.Join(changes, ",")})
+		}
+	}
+	for path := range bNodes {
+		if _, ok := aNodes[path]; !ok {
+			entries = append(entries, DiffEntry{Path: path, Type: DiffAdded})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// DiffBackups compares two export documents, offline, returning the paths added, removed or changed from jsonA to jsonB.
+func (zook *ZooKeeper) DiffBackups(jsonA, jsonB []byte) ([]DiffEntry, error) {
+	a, err := parseExport(jsonA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseExport(jsonB)
+	if err != nil {
+		return nil, err
+	}
+	return zook.diffExports(a, b), nil
+}
+
+// ExportSubtree returns an export document of given path and all its descendants, with their data and ACLs,
+// sorted by path. Ephemeral nodes, which belong to their sessions, and ZooKeeper's own /zookeeper subtree are
+// skipped. The subtree is read node by node, hence the export is not an atomic snapshot of a subtree being
+// modified.
+func (zook *ZooKeeper) ExportSubtree(path string) ([]byte, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	nodes, err := zook.readSubtree(connection, path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	export := &Export{Root: path, Nodes: []ExportedNode{}}
+	for _, node := range nodes {
+		nodePath := gopath.Join(path, node.relativePath)
+		if node.stat.EphemeralOwner != 0 || isSystemPath(nodePath) {
+			continue
+		}
+		export.Nodes = append(export.Nodes, ExportedNode{Path: nodePath, Data: node.data, ACL: zook.aclsToString(node.acl)})
+	}
+	sort.Slice(export.Nodes, func(i, j int) bool { return export.Nodes[i].Path < export.Nodes[j].Path })
+	return encodeExport(export)
+}
+
+// ValidateBackup checks an export document for internal consistency, offline: that the root and all paths are
+// well formed, that paths are under the root and unique, that every node but the root has its parent in the
+// document, and that ACLs parse. It returns the problems found, if any, or an error if the document does not
+// parse at all, e.g. due to data which is not valid base64.
+func (zook *ZooKeeper) ValidateBackup(jsonData []byte) ([]string, error) {
+	export, err := parseExport(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	wellFormed := func(path string) bool {
+		return strings.HasPrefix(path, "/") && gopath.Clean(path) == path
+	}
+	if !wellFormed(export.Root) {
+		return append(problems, fmt.Sprintf("invalid root %q", export.Root)), nil
+	}
+	paths := make(map[string]bool)
+	for _, node := range export.Nodes {
+		if wellFormed(node.Path) && isDescendantOrSelf(node.Path, export.Root) {
+			paths[node.Path] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, node := range export.Nodes {
+		if !wellFormed(node.Path) {
+			problems = append(problems, fmt.Sprintf("invalid path %q", node.Path))
+			continue
+		}
+		if !isDescendantOrSelf(node.Path, export.Root) {
+			problems = append(problems, fmt.Sprintf("%s: not under root %s", node.Path, export.Root))
+			continue
+		}
+		if seen[node.Path] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate path", node.Path))
+			continue
+		}
+		seen[node.Path] = true
+		if parent := gopath.Dir(node.Path); node.Path != export.Root && !paths[parent] {
+			problems = append(problems, fmt.Sprintf("%s: missing parent %s", node.Path, parent))
+		}
+		if len(node.ACL) > 0 {
+			if _, err := zook.parseACLString(strings.Join(node.ACL, ",")); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid ACL %q: %+v", node.Path, strings.Join(node.ACL, ","), err))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// ImportSubtree recreates the nodes of an export document, as ExportSubtree produces, with their data and ACLs.
+// The document is checked with ValidateBackup first, and rejected, having written nothing, if found inconsistent.
+// Missing parents of the export's root are created. Without force, ImportSubtree fails, having written nothing,
+// if any of the nodes exists; with force, existing nodes get their data and ACL overwritten. Nodes are written
+// ancestor first, one at a time, created with the default ACL; their ACLs are then set descendant first, so that
+// an ACL denying this session the creation of children, e.g. world:anyone:r, does not get in the way. Should a
+// write fail, the nodes written thus far remain.
+func (zook *ZooKeeper) ImportSubtree(data []byte, force bool) error {
+	problems, err := zook.ValidateBackup(data)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("inconsistent export document: %s", strings.Join(problems, "; "))
+	}
+	export, err := parseExport(data)
+	if err != nil {
+		return err
+	}
+	acls := make([][]zk.ACL, len(export.Nodes))
+	for i, node := range export.Nodes {
+		acls[i] = zook.acl
+		if len(node.ACL) > 0 {
+			if acls[i], err = zook.parseACLString(strings.Join(node.ACL, ",")); err != nil {
+				return fmt.Errorf("invalid ACL of %s: %+v", node.Path, err)
+			}
+		}
+	}
+	order := make([]int, len(export.Nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return export.Nodes[order[i]].Path < export.Nodes[order[j]].Path })
+
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	existing := make(map[string]bool)
+	conflicts := []string{}
+	for _, node := range export.Nodes {
+		zook.throttle(1)
+		exists, _, err := connection.Exists(node.Path)
+		if err != nil {
+			return wrapError(node.Path, err)
+		}
+		if exists {
+			existing[node.Path] = true
+			conflicts = append(conflicts, node.Path)
+		}
+	}
+	if len(conflicts) > 0 && !force {
+		return fmt.Errorf("nodes exist: %s", strings.Join(conflicts, ", "))
+	}
+
+	if parent := gopath.Dir(export.Root); parent != "/" {
+		if _, err := zook.createInternal(connection, parent, zook.autoParentData, zook.acl, true, zook.autoParentData); err != nil && err != zk.ErrNodeExists {
+			return wrapError(parent, err)
+		}
+	}
+	for _, i := range order {
+		node := export.Nodes[i]
+		if !existing[node.Path] {
+			if _, err := zook.createNode(connection, node.Path, node.Data, 0, zook.acl); err != nil {
+				return fmt.Errorf("cannot create %s: %w", node.Path, wrapError(node.Path, err))
+			}
+			continue
+		}
+		if _, err := zook.setNode(connection, node.Path, node.Data, -1); err != nil {
+			return fmt.Errorf("cannot set %s: %w", node.Path, wrapError(node.Path, err))
+		}
+	}
+	// Descendants sort after their ancestors
+	for j := len(order) - 1; j >= 0; j-- {
+		i := order[j]
+		node := export.Nodes[i]
+		if !existing[node.Path] && ACLEqual(acls[i], zook.acl) {
+			continue
+		}
+		if _, err := zook.setNodeACL(connection, node.Path, acls[i], -1); err != nil {
+			return fmt.Errorf("cannot set ACL of %s: %w", node.Path, wrapError(node.Path, err))
+		}
+	}
+	return nil
+}
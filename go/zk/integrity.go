@@ -0,0 +1,138 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+)
+
+// IntegrityIssue describes an inconsistency between a node and its parent's listing
+type IntegrityIssue struct {
+	Path    string
+	Problem string
+}
+
+func (issue IntegrityIssue) String() string {
+	return fmt.Sprintf("%s: %s", issue.Path, issue.Problem)
+}
+
+// checkIntegrityInternal: internal implementation of integrity check, walking given path, which was listed by its parent
+func (zook *ZooKeeper) checkIntegrityInternal(connection *zk.Conn, path string) ([]IntegrityIssue, error) {
+	issues := []IntegrityIssue{}
+	zook.throttle(1)
+	children, stat, err := connection.Children(path)
+	if err == zk.ErrNoNode {
+		return append(issues, IntegrityIssue{Path: path, Problem: "listed by parent but does not exist"}), nil
+	}
+	if err != nil {
+		return issues, err
+	}
+	if int(stat.NumChildren) != len(children) {
+		issues = append(issues, IntegrityIssue{Path: path, Problem: fmt.Sprintf("has %d children but lists %d", stat.NumChildren, len(children))})
+	}
+	for _, child := range children {
+		childIssues, err := zook.checkIntegrityInternal(connection, gopath.Join(path, child))
+		issues = append(issues, childIssues...)
+		if err != nil {
+			return issues, err
+		}
+	}
+	return issues, nil
+}
+
+// CheckIntegrity walks given path and its descendants and reports nodes listed as children yet
+// nonexistent, existing nodes not listed by their parent, and nodes whose children count disagrees with
+// their children listing. It is read only. Since the walk is not atomic, concurrent modifications
+// to the subtree may show up as issues; re-run to confirm.
+func (zook *ZooKeeper) CheckIntegrity(path string) ([]IntegrityIssue, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	issues := []IntegrityIssue{}
+	if exists, _, err := connection.Exists(path); err != nil {
+		return nil, wrapError(path, err)
+	} else if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	if parentPath := gopath.Dir(path); parentPath != path {
+		siblings, _, err := connection.Children(parentPath)
+		if err != nil {
+			return nil, wrapError(parentPath, err)
+		}
+		listed := false
+		for _, sibling := range siblings {
+			listed = listed || sibling == gopath.Base(path)
+		}
+		if !listed {
+			issues = append(issues, IntegrityIssue{Path: path, Problem: "exists but not listed by parent"})
+		}
+	}
+	childIssues, err := zook.checkIntegrityInternal(connection, path)
+	return append(issues, childIssues...), wrapError(path, err)
+}
+
+// emptyLeavesInternal: walks given path and its descendants, collecting leaves with no data
+func (zook *ZooKeeper) emptyLeavesInternal(connection *zk.Conn, path string) ([]string, error) {
+	zook.throttle(1)
+	children, stat, err := connection.Children(path)
+	if err == zk.ErrNoNode {
+		// deleted since listed by its parent
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 0 {
+		if stat.DataLength == 0 {
+			return []string{path}, nil
+		}
+		return []string{}, nil
+	}
+	result := []string{}
+	for _, child := range children {
+		childResult, err := zook.emptyLeavesInternal(connection, gopath.Join(path, child))
+		result = append(result, childResult...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// RequireNonEmptyLeaves returns the leaves (nodes without children) under given path, or the path itself if it
+// is a leaf, whose data is empty. Empty internal nodes are not reported. Data lengths are taken from the stat
+// returned with each children listing, so no data is read.
+func (zook *ZooKeeper) RequireNonEmptyLeaves(path string) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	if exists, _, err := connection.Exists(path); err != nil {
+		return nil, wrapError(path, err)
+	} else if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	result, err := zook.emptyLeavesInternal(connection, path)
+	return result, wrapError(path, err)
+}
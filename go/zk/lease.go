@@ -0,0 +1,195 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lease is a session independent lock on a path, held for as long as its holder keeps renewing it.
+//
+// ZooKeeper 3.5.3 introduced TTL nodes for this purpose, but the go-zookeeper client we build with
+// cannot create them. A lease is therefore a persistent node whose data is the lease's expiry time
+// (unix epoch milliseconds). The holder periodically pushes the expiry forward using versioned writes.
+// A lease whose expiry has passed may be taken over by another AcquireLease. The node is not removed
+// by the server upon expiry. Expiry is evaluated with the clients' clocks, which should be in sync.
+//
+// Unlike an ephemeral node, a lease survives disconnects and session expiration, as long as renewal
+// resumes before the lease expires. Should renewal fail up to the point the lease expires, or should
+// the node be modified or removed by anyone else, the lease is considered lost: renewal stops and the
+// Lost() channel is closed. The holder must then stop acting as owner.
+type Lease struct {
+	zook       *ZooKeeper
+	connection *zk.Conn
+	path       string
+	ttl        time.Duration
+
+	mutex    sync.Mutex
+	version  int32
+	deadline time.Time
+	lost     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+
+	releaseOnce sync.Once
+}
+
+// MinLeaseTTL is the shortest ttl AcquireLease accepts. Leases are renewed every third of their ttl,
+// and shorter ttls would have the holder do little but renew.
+const MinLeaseTTL = 100 * time.Millisecond
+
+func leaseData(deadline time.Time) []byte {
+	return []byte(strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10))
+}
+
+func parseLeaseData(data []byte) (time.Time, error) {
+	millis, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("not a lease: %q", data)
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), nil
+}
+
+// AcquireLease claims a lease on given path for given ttl, and keeps renewing it in the background
+// until Release() is called or the lease is lost. It returns with error if the lease is held by another,
+// unexpired, holder.
+func (zook *ZooKeeper) AcquireLease(path string, ttl time.Duration) (*Lease, error) {
+	if ttl < MinLeaseTTL {
+		return nil, fmt.Errorf("lease ttl must be at least %+v, got %+v", MinLeaseTTL, ttl)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{
+		zook:       zook,
+		connection: connection,
+		path:       path,
+		ttl:        ttl,
+		lost:       make(chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := lease.claim(); err != nil {
+		connection.Close()
+		return nil, wrapError(path, err)
+	}
+	go lease.renewLoop()
+	return lease, nil
+}
+
+// claim: create the lease node, or take over an expired one
+func (lease *Lease) claim() error {
+	deadline := time.Now().Add(lease.ttl)
+	_, err := lease.zook.createNode(lease.connection, lease.path, leaseData(deadline), 0, lease.zook.acl)
+	if err == nil {
+		lease.version, lease.deadline = 0, deadline
+		return nil
+	}
+	if err != zk.ErrNodeExists {
+		return err
+	}
+	data, stat, err := lease.connection.Get(lease.path)
+	if err != nil {
+		return err
+	}
+	expiry, err := parseLeaseData(data)
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(expiry) {
+		return fmt.Errorf("lease on %s is held until %s", lease.path, expiry)
+	}
+	stat, err = lease.zook.setNode(lease.connection, lease.path, leaseData(deadline), stat.Version)
+	if err == zk.ErrBadVersion {
+		return fmt.Errorf("lease on %s was claimed concurrently", lease.path)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Took over expired lease on %s", lease.path)
+	lease.version, lease.deadline = stat.Version, deadline
+	return nil
+}
+
+// renewLoop: renews the lease every third of its ttl
+func (lease *Lease) renewLoop() {
+	defer close(lease.done)
+	ticker := time.NewTicker(lease.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+		}
+		lease.mutex.Lock()
+		deadline := time.Now().Add(lease.ttl)
+		stat, err := lease.zook.setNode(lease.connection, lease.path, leaseData(deadline), lease.version)
+		if err == nil {
+			lease.version, lease.deadline = stat.Version, deadline
+		}
+		expired := time.Now().After(lease.deadline)
+		lease.mutex.Unlock()
+
+		if err == nil {
+			continue
+		}
+		if err == zk.ErrBadVersion || err == zk.ErrNoNode || expired {
+			log.Errorf("Lost lease on %s: %+v", lease.path, err)
+			close(lease.lost)
+			return
+		}
+		log.Warningf("Failed renewing lease on %s, will retry: %+v", lease.path, err)
+	}
+}
+
+// Lost returns a channel which is closed when the lease is lost
+func (lease *Lease) Lost() <-chan struct{} {
+	return lease.lost
+}
+
+// Release stops renewing the lease and deletes its node. Releasing a lost lease only stops renewal. Releasing a
+// released lease does nothing.
+func (lease *Lease) Release() error {
+	var err error
+	lease.releaseOnce.Do(func() {
+		err = lease.release()
+	})
+	return err
+}
+
+// release: stops renewal, and deletes the node unless the lease was lost
+func (lease *Lease) release() error {
+	close(lease.stop)
+	<-lease.done
+	defer lease.connection.Close()
+
+	select {
+	case <-lease.lost:
+		return nil
+	default:
+	}
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	return lease.zook.deleteNode(lease.connection, lease.path, lease.version)
+}
@@ -0,0 +1,216 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lockPrefix names the nodes contending for a lock, which CreateProtectedEphemeralSequential prefixes with a
+// GUID and suffixes with a sequence number
+const lockPrefix = "lock-"
+
+// sequenceLength is the length of the zero padded sequence number the server appends to sequential nodes
+const sequenceLength = 10
+
+// Lock is an exclusive lock on a path, following ZooKeeper's lock recipe: each contender creates an ephemeral
+// sequential child of the path, and holds the lock once its child is the lowest; until then it watches the child
+// just below its own, so that releasing the lock wakes up a single contender. The child is created with
+// Client.CreateProtectedEphemeralSequential, which does not leak it should the connection be lost while
+// creating.
+//
+// A lock holds a connection of its own from Acquire to Release. Being ephemeral, the child goes away along with
+// the session, should the session expire, and the lock is then lost: Lost() is closed, and the holder must stop
+// acting as owner. A Lock is not safe for concurrent use; contenders each use a Lock of their own.
+type Lock struct {
+	zook   *ZooKeeper
+	client *Client
+	node   string
+	lost   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewLock returns a lock, to be acquired with this ZooKeeper's settings
+func (zook *ZooKeeper) NewLock() *Lock {
+	return &Lock{zook: zook}
+}
+
+// lockSequence returns the sequence number of a lock node, by which contenders are ordered
+func lockSequence(name string) string {
+	if len(name) < sequenceLength {
+		return name
+	}
+	return name[len(name)-sequenceLength:]
+}
+
+// Acquire waits up to given timeout for the lock on given path, creating the path, along with its missing
+// parents, as needed. Should the timeout pass, or the session be lost, while waiting, Acquire deletes its child
+// and returns with error.
+func (lock *Lock) Acquire(path string, timeout time.Duration) error {
+	if lock.client != nil {
+		return fmt.Errorf("lock on %s already held", gopath.Dir(lock.node))
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("lock timeout must be positive, got %+v", timeout)
+	}
+	expired := time.After(timeout)
+	client, err := lock.zook.NewClient()
+	if err != nil {
+		return err
+	}
+	if err := lock.zook.createParentsInternal(client.connection, path, lock.zook.acl, lock.zook.autoParentData); err != nil {
+		client.Close()
+		return wrapError(path, err)
+	}
+	node, err := client.CreateProtectedEphemeralSequential(gopath.Join(path, lockPrefix), []byte{}, "")
+	if err != nil {
+		client.Close()
+		return err
+	}
+	if err := lock.wait(client, path, gopath.Base(node), expired); err != nil {
+		if err := lock.zook.deleteNode(client.connection, node, -1); err != nil && err != zk.ErrNoNode {
+			log.Warningf("Cannot delete %s: %+v", node, err)
+		}
+		client.Close()
+		return err
+	}
+
+	events, err := lock.watchNode(client, node)
+	if err != nil {
+		client.Close()
+		return wrapError(node, err)
+	}
+	lock.client, lock.node = client, node
+	lock.lost, lock.stop, lock.done = make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go lock.watch(events)
+	return nil
+}
+
+// wait returns once given node is the lowest contender under path, or with error once expired
+func (lock *Lock) wait(client *Client, path string, name string, expired <-chan time.Time) error {
+	for {
+		children, err := client.Children(path)
+		if err != nil {
+			return err
+		}
+		contenders := []string{}
+		for _, child := range children {
+			if strings.Contains(child, lockPrefix) {
+				contenders = append(contenders, child)
+			}
+		}
+		sort.Slice(contenders, func(i, j int) bool {
+			return lockSequence(contenders[i]) < lockSequence(contenders[j])
+		})
+		index := sort.Search(len(contenders), func(i int) bool {
+			return lockSequence(contenders[i]) >= lockSequence(name)
+		})
+		if index == len(contenders) || contenders[index] != name {
+			return fmt.Errorf("lock on %s lost while waiting: %s is gone", path, name)
+		}
+		if index == 0 {
+			return nil
+		}
+
+		lock.zook.throttle(1)
+		exists, _, events, err := client.connection.ExistsW(gopath.Join(path, contenders[index-1]))
+		if err != nil {
+			return wrapError(path, err)
+		}
+		if !exists {
+			continue
+		}
+		select {
+		case event := <-events:
+			if event.Err != nil {
+				return wrapError(path, event.Err)
+			}
+		case <-expired:
+			return fmt.Errorf("timed out waiting for lock on %s", path)
+		}
+	}
+}
+
+// watchNode arms an existence watch on the lock's own node, which must exist
+func (lock *Lock) watchNode(client *Client, node string) (<-chan zk.Event, error) {
+	lock.zook.throttle(1)
+	exists, _, events, err := client.connection.ExistsW(node)
+	if err == nil && !exists {
+		err = zk.ErrNoNode
+	}
+	return events, err
+}
+
+// watch closes the lost channel should the lock's node go away, or the session be lost, before Release
+func (lock *Lock) watch(events <-chan zk.Event) {
+	defer close(lock.done)
+	for {
+		var event zk.Event
+		select {
+		case <-lock.stop:
+			return
+		case event = <-events:
+		}
+		var err error
+		if event.Err == nil && event.Type != zk.EventNotWatching {
+			if events, err = lock.watchNode(lock.client, lock.node); err == nil {
+				continue
+			}
+		} else {
+			err = event.Err
+		}
+		log.Errorf("Lost lock on %s: %+v", gopath.Dir(lock.node), err)
+		close(lock.lost)
+		return
+	}
+}
+
+// Lost returns a channel which is closed should the lock be lost while held, or nil if the lock is not held
+func (lock *Lock) Lost() <-chan struct{} {
+	return lock.lost
+}
+
+// Release deletes the lock's node, letting the next contender acquire the lock, and closes the lock's
+// connection. Releasing a lost lock only closes the connection. The lock may then be acquired anew.
+func (lock *Lock) Release() error {
+	if lock.client == nil {
+		return errors.New("lock not held")
+	}
+	close(lock.stop)
+	<-lock.done
+	client, node := lock.client, lock.node
+	lock.client, lock.node = nil, ""
+	defer client.Close()
+
+	select {
+	case <-lock.lost:
+		return nil
+	default:
+	}
+	if err := lock.zook.deleteNode(client.connection, node, -1); err != nil && err != zk.ErrNoNode {
+		return wrapError(node, err)
+	}
+	return nil
+}
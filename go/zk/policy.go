@@ -0,0 +1,200 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	gopath "path"
+	"sort"
+	"strings"
+)
+
+// ACLPolicy declares the ACL nodes should have. A policy file is the JSON encoding of an ACLPolicy, e.g.:
+//
+//	{"rules": [
+//	  {"path": "/app", "acl": "world:anyone:r"},
+//	  {"path": "/app/*/secrets", "acl": "digest:admin:hash:cdrwa", "recursive": true}
+//	]}
+type ACLPolicy struct {
+	Rules []ACLPolicyRule `json:"rules"`
+}
+
+// ACLPolicyRule applies an ACL, in the format accepted by setacl, to the nodes matching a path pattern.
+// Patterns use path.Match syntax, where "*" matches within a single path element. A recursive rule also
+// applies to all descendants of matching nodes; a recursive rule on "/" thus applies to all nodes.
+type ACLPolicyRule struct {
+	Path      string `json:"path"`
+	ACL       string `json:"acl"`
+	Recursive bool   `json:"recursive"`
+
+	acl []zk.ACL
+}
+
+// walkRoot returns the longest leading part of the rule's pattern which has no wildcards
+func (rule *ACLPolicyRule) walkRoot() string {
+	root := "/"
+	for _, element := range strings.Split(strings.Trim(rule.Path, "/"), "/") {
+		if strings.ContainsAny(element, `*?[\`) {
+			break
+		}
+		root = gopath.Join(root, element)
+	}
+	return root
+}
+
+// matches returns true when the rule applies to given path
+func (rule *ACLPolicyRule) matches(path string) bool {
+	if matched, _ := gopath.Match(rule.Path, path); matched {
+		return true
+	}
+	if !rule.Recursive {
+		return false
+	}
+	for ancestor := path; ancestor != "/"; {
+		ancestor = gopath.Dir(ancestor)
+		if matched, _ := gopath.Match(rule.Path, ancestor); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateACLPolicy checks rules are well formed, and parses their ACLs
+func (zook *ZooKeeper) validateACLPolicy(policy *ACLPolicy) error {
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("policy rule %d: path must be absolute: %q", i, rule.Path)
+		}
+		if _, err := gopath.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("policy rule %d: invalid path pattern %q: %+v", i, rule.Path, err)
+		}
+		acl, err := zook.parseACLString(rule.ACL)
+		if err != nil {
+			return fmt.Errorf("policy rule %d: invalid acl %q: %+v", i, rule.ACL, err)
+		}
+		rule.acl = acl
+	}
+	return nil
+}
+
+// ApplyACLPolicy reads a policy file (see ACLPolicy) and sets the declared ACL on each node the policy applies to,
+// skipping nodes which already have it. The policy is validated, and the full set of changes is computed, before
+// anything is written: nodes matched by rules of different ACLs fail the entire operation. With dryRun nothing is
+// written. ZooKeeper's own /zookeeper tree is left alone, unless rules are rooted within it. Returns the paths which
+// were (or, with dryRun, would be) changed.
+func (zook *ZooKeeper) ApplyACLPolicy(policyFile string, dryRun bool) ([]string, error) {
+	content, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	policy := &ACLPolicy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("cannot parse policy file %s: %+v", policyFile, err)
+	}
+	if err := zook.validateACLPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	// Collect all nodes under the rules' walk roots
+	nodePaths := []string{}
+	walked := make(map[string]bool)
+	for _, rule := range policy.Rules {
+		root := rule.walkRoot()
+		if walked[root] {
+			continue
+		}
+		descendants, err := zook.childrenRecursiveInternal(connection, root, "")
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, wrapError(root, err)
+		}
+		for _, relativePath := range append([]string{""}, descendants...) {
+			nodePath := gopath.Join(root, relativePath)
+			if isSystemPath(nodePath) && !isSystemPath(root) {
+				continue
+			}
+			if !walked[nodePath] {
+				walked[nodePath] = true
+				nodePaths = append(nodePaths, nodePath)
+			}
+		}
+	}
+	sort.Strings(nodePaths)
+
+	// Plan
+	desired := make(map[string][]zk.ACL)
+	conflicts := []string{}
+	for _, nodePath := range nodePaths {
+		for _, rule := range policy.Rules {
+			if !rule.matches(nodePath) {
+				continue
+			}
+			if acl, ok := desired[nodePath]; ok && !ACLEqual(acl, rule.acl) {
+				conflicts = append(conflicts, nodePath)
+				break
+			}
+			desired[nodePath] = rule.acl
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("conflicting policy rules for: %s", strings.Join(conflicts, ", "))
+	}
+	type change struct {
+		path     string
+		aversion int32
+	}
+	changes := []change{}
+	for _, nodePath := range nodePaths {
+		acl, ok := desired[nodePath]
+		if !ok {
+			continue
+		}
+		zook.throttle(1)
+		current, stat, err := connection.GetACL(nodePath)
+		if err != nil {
+			return nil, wrapError(nodePath, err)
+		}
+		if !ACLEqual(current, acl) {
+			changes = append(changes, change{path: nodePath, aversion: stat.Aversion})
+		}
+	}
+
+	// Apply
+	changed := []string{}
+	for _, c := range changes {
+		if dryRun {
+			log.Infof("Would set ACL of %s to %s", c.path, strings.Join(zook.aclsToString(desired[c.path]), ","))
+		} else if _, err := zook.setNodeACL(connection, c.path, desired[c.path], c.aversion); err != nil {
+			return changed, wrapError(c.path, err)
+		}
+		changed = append(changed, c.path)
+	}
+	return changed, nil
+}
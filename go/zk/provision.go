@@ -0,0 +1,241 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	gopath "path"
+	"sort"
+	"strings"
+)
+
+// ProvisionSpec declares the desired state of a set of nodes. A spec file is the JSON encoding of a
+// ProvisionSpec, e.g.:
+//
+//	{"nodes": [
+//	  {"path": "/app/config", "data": "replicas=3", "acl": "world:anyone:r"},
+//	  {"path": "/app/locks"},
+//	  {"path": "/app/legacy", "delete": true}
+//	]}
+type ProvisionSpec struct {
+	Nodes []ProvisionNode `json:"nodes"`
+}
+
+// ProvisionNode declares a single node. A node without data, or without an ACL, has the data, or the ACL, of
+// an existing node left as is; created nodes then get empty data, or the default ACL. A node marked for deletion
+// is deleted along with its descendants, and may declare neither data nor ACL.
+type ProvisionNode struct {
+	Path   string  `json:"path"`
+	Data   *string `json:"data"`
+	ACL    string  `json:"acl"`
+	Delete bool    `json:"delete"`
+
+	acl []zk.ACL
+}
+
+// ProvisionAction is a single change Provision makes: Op is one of "create", "set", "setacl" and "delete"
+type ProvisionAction struct {
+	Op   string
+	Path string
+
+	data    []byte
+	acl     []zk.ACL
+	version int32
+}
+
+func (action ProvisionAction) String() string {
+	return fmt.Sprintf("%s %s", action.Op, action.Path)
+}
+
+// ProvisionReport lists the changes Provision computed, in the order it applies them. Applied is the number of
+// leading actions which were applied, which falls short of the number of actions on dry run or error.
+type ProvisionReport struct {
+	Actions []ProvisionAction
+	Applied int
+}
+
+// validateProvisionSpec checks nodes are well formed and do not contradict one another, and parses their ACLs
+func (zook *ZooKeeper) validateProvisionSpec(spec *ProvisionSpec) error {
+	declared := make(map[string]bool)
+	deleted := []string{}
+	for i := range spec.Nodes {
+		node := &spec.Nodes[i]
+		if !strings.HasPrefix(node.Path, "/") || node.Path == "/" || gopath.Clean(node.Path) != node.Path {
+			return fmt.Errorf("spec node %d: invalid path %q", i, node.Path)
+		}
+		if declared[node.Path] {
+			return fmt.Errorf("spec node %d: %s declared more than once", i, node.Path)
+		}
+		declared[node.Path] = true
+		if node.Delete {
+			if node.Data != nil || node.ACL != "" {
+				return fmt.Errorf("spec node %d: %s is marked for deletion, yet declares data or acl", i, node.Path)
+			}
+			deleted = append(deleted, node.Path)
+			continue
+		}
+		if node.ACL != "" {
+			acl, err := zook.parseACLString(node.ACL)
+			if err != nil {
+				return fmt.Errorf("spec node %d: invalid acl %q: %+v", i, node.ACL, err)
+			}
+			node.acl = acl
+		}
+	}
+	for _, node := range spec.Nodes {
+		for _, deletedPath := range deleted {
+			if !node.Delete && strings.HasPrefix(node.Path, deletedPath+"/") {
+				return fmt.Errorf("%s is declared under %s, which is marked for deletion", node.Path, deletedPath)
+			}
+		}
+	}
+	return nil
+}
+
+// Provision reads a spec file (see ProvisionSpec) and converges the nodes it declares to their declared state:
+// it deletes the nodes marked for deletion, creates missing nodes along with their missing parents, and sets
+// data and ACLs which differ from the declared ones. Nodes not declared are otherwise left alone, making
+// Provision idempotent. The spec is validated, and all changes are computed, before anything is written; with
+// dryRun nothing is written. Changes are applied in the order reported, each expecting the version read while
+// computing them, so that Provision fails on nodes concurrently modified by others.
+func (zook *ZooKeeper) Provision(specFile string, dryRun bool) (ProvisionReport, error) {
+	report := ProvisionReport{Actions: []ProvisionAction{}}
+	content, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return report, err
+	}
+	spec := &ProvisionSpec{}
+	if err := json.Unmarshal(content, spec); err != nil {
+		return report, fmt.Errorf("cannot parse spec file %s: %+v", specFile, err)
+	}
+	if err := zook.validateProvisionSpec(spec); err != nil {
+		return report, err
+	}
+	// Parents come before their children
+	sort.Slice(spec.Nodes, func(i, j int) bool { return spec.Nodes[i].Path < spec.Nodes[j].Path })
+
+	connection, err := zook.connect()
+	if err != nil {
+		return report, err
+	}
+	defer connection.Close()
+
+	// Plan: deletions first, deepest first
+	for i := len(spec.Nodes) - 1; i >= 0; i-- {
+		node := spec.Nodes[i]
+		if !node.Delete {
+			continue
+		}
+		zook.throttle(1)
+		exists, _, err := connection.Exists(node.Path)
+		if err != nil {
+			return report, wrapError(node.Path, err)
+		}
+		if exists {
+			report.Actions = append(report.Actions, ProvisionAction{Op: "delete", Path: node.Path})
+		}
+	}
+	created := make(map[string]bool)
+	for _, node := range spec.Nodes {
+		if node.Delete {
+			continue
+		}
+		if created[gopath.Dir(node.Path)] {
+			// the parent is yet to be created, and so is this node
+			report.Actions = append(report.Actions, zook.provisionCreate(node))
+			created[node.Path] = true
+			continue
+		}
+		zook.throttle(1)
+		data, stat, err := connection.Get(node.Path)
+		if err == zk.ErrNoNode {
+			missingParents := []string{}
+			for parent := gopath.Dir(node.Path); parent != "/" && !created[parent]; parent = gopath.Dir(parent) {
+				zook.throttle(1)
+				exists, _, err := connection.Exists(parent)
+				if err != nil {
+					return report, wrapError(parent, err)
+				}
+				if exists {
+					break
+				}
+				missingParents = append([]string{parent}, missingParents...)
+			}
+			for _, parent := range missingParents {
+				report.Actions = append(report.Actions, ProvisionAction{Op: "create", Path: parent, data: zook.autoParentData, acl: zook.acl})
+				created[parent] = true
+			}
+			report.Actions = append(report.Actions, zook.provisionCreate(node))
+			created[node.Path] = true
+			continue
+		}
+		if err != nil {
+			return report, wrapError(node.Path, err)
+		}
+		if node.Data != nil && !bytes.Equal(data, []byte(*node.Data)) {
+			report.Actions = append(report.Actions, ProvisionAction{Op: "set", Path: node.Path, data: []byte(*node.Data), version: stat.Version})
+		}
+		if node.acl != nil {
+			zook.throttle(1)
+			acl, stat, err := connection.GetACL(node.Path)
+			if err != nil {
+				return report, wrapError(node.Path, err)
+			}
+			if !ACLEqual(acl, node.acl) {
+				report.Actions = append(report.Actions, ProvisionAction{Op: "setacl", Path: node.Path, acl: node.acl, version: stat.Aversion})
+			}
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// Apply
+	for _, action := range report.Actions {
+		switch action.Op {
+		case "delete":
+			err = zook.deleteRecursiveStreamingInternal(connection, action.Path, make(chan struct{}, maxConcurrency))
+		case "create":
+			_, err = zook.createNode(connection, action.Path, action.data, 0, action.acl)
+		case "set":
+			_, err = zook.setNode(connection, action.Path, action.data, action.version)
+		case "setacl":
+			_, err = zook.setNodeACL(connection, action.Path, action.acl, action.version)
+		}
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", action, wrapError(action.Path, err))
+		}
+		report.Applied++
+	}
+	return report, nil
+}
+
+// provisionCreate returns the action creating given declared node
+func (zook *ZooKeeper) provisionCreate(node ProvisionNode) ProvisionAction {
+	action := ProvisionAction{Op: "create", Path: node.Path, data: []byte{}, acl: node.acl}
+	if node.Data != nil {
+		action.data = []byte(*node.Data)
+	}
+	if action.acl == nil {
+		action.acl = zook.acl
+	}
+	return action
+}
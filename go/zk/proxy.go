@@ -0,0 +1,262 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SetProxy routes connections to the servers through given proxy, e.g. on a bastion host, given as
+// socks5://[user:password@]host[:port] (port defaults to 1080) or http://[user:password@]host[:port] (port
+// defaults to 80; the proxy must allow CONNECT to the servers' ports). Server names are resolved by the proxy.
+// Server probes and four letter words go through the proxy as well. An empty URL removes the proxy.
+func (zook *ZooKeeper) SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		zook.proxy = nil
+		return nil
+	}
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %q: %+v", proxyURL, err)
+	}
+	defaultPort := ""
+	switch parsed.Scheme {
+	case "socks5":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	default:
+		return fmt.Errorf("invalid proxy URL %q: scheme must be socks5 or http", proxyURL)
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("invalid proxy URL %q: missing host", proxyURL)
+	}
+	if parsed.Port() == "" {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), defaultPort)
+	}
+	zook.proxy = parsed
+	return nil
+}
+
+// dial connects to given address, through the proxy if one is set, and over TLS if configured
+func (zook *ZooKeeper) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := zook.dialProxied(network, address, timeout)
+	if err != nil || zook.tlsConfig == nil {
+		return conn, err
+	}
+	return tlsHandshake(conn, address, zook.tlsConfig, timeout)
+}
+
+// dialProxied connects to given address, through the proxy if one is set
+func (zook *ZooKeeper) dialProxied(network, address string, timeout time.Duration) (net.Conn, error) {
+	if zook.proxy == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+	conn, err := net.DialTimeout("tcp", zook.proxy.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %+v", zook.proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if zook.proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, address, zook.proxy.User)
+	} else {
+		err = httpConnect(conn, address, zook.proxy.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: connecting to %s: %+v", zook.proxy.Host, address, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect to given address (RFC 1928),
+// authenticating with username and password if given (RFC 1929)
+func socks5Connect(conn net.Conn, address string, user *url.Userinfo) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", address)
+	}
+
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return errors.New("proxy refused authentication method")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		request := []byte{0x01, byte(len(user.Username()))}
+		request = append(request, user.Username()...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("proxy authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 0x01), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 0x04), ip.To16()...)
+	} else {
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		if message, ok := socks5Replies[header[1]]; ok {
+			return errors.New(message)
+		}
+		return fmt.Errorf("connect failed with reply %d", header[1])
+	}
+	// Skip the bound address and port
+	addressLength := 0
+	switch header[3] {
+	case 0x01:
+		addressLength = net.IPv4len
+	case 0x04:
+		addressLength = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addressLength = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type %d in reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to tunnel to given address, authenticating with
+// basic authentication if a user is given
+func httpConnect(conn net.Conn, address string, user *url.Userinfo) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return err
+	}
+	// Read byte by byte up to the end of the headers, so as not to consume any of the tunneled stream
+	var response bytes.Buffer
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(response.Bytes(), []byte("\r\n\r\n")) {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		response.Write(b)
+	}
+	statusLine := strings.SplitN(response.String(), "\r\n", 2)[0]
+	if fields := strings.Fields(statusLine); len(fields) < 2 || fields[1] != "200" {
+		return fmt.Errorf("proxy responded %q", statusLine)
+	}
+	return nil
+}
+
+// staticHostProvider hands out the servers as given, unlike the client library's default, which resolves them
+// locally; behind a proxy, the names are for the proxy to resolve
+type staticHostProvider struct {
+	mutex   sync.Mutex
+	servers []string
+	current int
+	last    int
+}
+
+func (provider *staticHostProvider) Init(servers []string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.servers = servers
+	provider.current, provider.last = -1, -1
+	return nil
+}
+
+func (provider *staticHostProvider) Len() int {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	return len(provider.servers)
+}
+
+func (provider *staticHostProvider) Next() (server string, retryStart bool) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.current = (provider.current + 1) % len(provider.servers)
+	retryStart = provider.current == provider.last
+	if provider.last == -1 {
+		provider.last = 0
+	}
+	return provider.servers[provider.current], retryStart
+}
+
+func (provider *staticHostProvider) Connected() {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.last = provider.current
+}
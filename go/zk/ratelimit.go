@@ -0,0 +1,78 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket paces callers to a given rate, allowing bursts of up to one second's worth of operations
+type tokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(opsPerSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:     float64(opsPerSecond),
+		capacity: float64(opsPerSecond),
+		tokens:   float64(opsPerSecond),
+		last:     time.Now(),
+	}
+}
+
+// take consumes given number of tokens, blocking until they are available. Tokens may go into debt,
+// which later callers pay off by waiting, so that concurrent callers are paced fairly.
+func (bucket *tokenBucket) take(count int) {
+	bucket.mutex.Lock()
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.last = now
+	bucket.tokens -= float64(count)
+	wait := time.Duration(0)
+	if bucket.tokens < 0 {
+		wait = time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	}
+	bucket.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// SetRateLimit caps the rate of requests which recursive and bulk operations issue, as well as of all
+// modifications, to given number of operations per second. Use this to limit the load a large cleanup or copy
+// puts on a live ensemble. Zero or less (the default) means unlimited.
+func (zook *ZooKeeper) SetRateLimit(opsPerSecond int) {
+	if opsPerSecond <= 0 {
+		zook.rateLimiter = nil
+		return
+	}
+	zook.rateLimiter = newTokenBucket(opsPerSecond)
+}
+
+// throttle blocks as required by the rate limit, if any, before issuing given number of operations
+func (zook *ZooKeeper) throttle(count int) {
+	if zook.rateLimiter != nil {
+		zook.rateLimiter.take(count)
+	}
+}
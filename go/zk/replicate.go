@@ -0,0 +1,216 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+	"strings"
+)
+
+// replicationEvent is a watch notification on a source node
+type replicationEvent struct {
+	path     string
+	children bool
+	event    zk.Event
+}
+
+// replicator holds the state of a Replicate run. Its maps are only accessed by the event loop.
+type replicator struct {
+	src, dst         *ZooKeeper
+	srcConn, dstConn *zk.Conn
+	srcRoot, dstRoot string
+	dataArmed        map[string]bool
+	childrenArmed    map[string]bool
+	events           chan replicationEvent
+	done             chan struct{}
+}
+
+// Replicate mirrors the subtree at srcPath on src onto dstPath on dst: it copies the subtree, then keeps
+// applying creations, data changes and deletions until stop is closed or an error occurs.
+//
+// ZooKeeper 3.6 persistent recursive watches are not supported by the go-zookeeper client we build with, hence
+// Replicate arms a data watch and a children watch per source node. Each node is read along with arming its
+// watch, so that no change following the initial copy is missed. Changes are applied at least once; a node
+// changing in quick succession may have only its latest data applied. ACL changes do not trigger watches, and
+// are only replicated along with the creation of a node. Ephemeral nodes are not replicated.
+//
+// The source wins all conflicts: data on the destination is overwritten, and nodes under dstPath which do not
+// exist under srcPath are deleted. Replicate returns with error when the source session expires; calling it
+// again resynchronizes the subtrees. Should srcPath be deleted, dstPath is deleted and Replicate returns nil.
+func Replicate(src *ZooKeeper, srcPath string, dst *ZooKeeper, dstPath string, stop <-chan struct{}) error {
+	srcConn, err := src.connect()
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.connect()
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	r := &replicator{
+		src:           src,
+		dst:           dst,
+		srcConn:       srcConn,
+		dstConn:       dstConn,
+		srcRoot:       srcPath,
+		dstRoot:       dstPath,
+		dataArmed:     make(map[string]bool),
+		childrenArmed: make(map[string]bool),
+		events:        make(chan replicationEvent),
+		done:          make(chan struct{}),
+	}
+	defer close(r.done)
+
+	if exists, _, err := srcConn.Exists(srcPath); err != nil {
+		return wrapError(srcPath, err)
+	} else if !exists {
+		return wrapError(srcPath, zk.ErrNoNode)
+	}
+	if err := r.refresh(srcPath); err != nil {
+		return wrapError(srcPath, err)
+	}
+	log.Infof("Replicated %s into %s, following changes", srcPath, dstPath)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e := <-r.events:
+			if e.event.Type == zk.EventNotWatching || e.event.Err != nil {
+				return fmt.Errorf("lost watch on %s: %+v", e.path, e.event.Err)
+			}
+			if e.children {
+				r.childrenArmed[e.path] = false
+			} else {
+				r.dataArmed[e.path] = false
+			}
+			if err := r.refresh(e.path); err != nil {
+				return wrapError(e.path, err)
+			}
+			if !r.dataArmed[srcPath] && !r.childrenArmed[srcPath] {
+				log.Infof("%s deleted, stopping replication", srcPath)
+				return nil
+			}
+		}
+	}
+}
+
+// dstPathOf maps a source path to its destination path
+func (r *replicator) dstPathOf(srcPath string) string {
+	return gopath.Join(r.dstRoot, strings.TrimPrefix(srcPath, r.srcRoot))
+}
+
+// forward passes the watch notification, once it fires, to the event loop
+func (r *replicator) forward(path string, children bool, events <-chan zk.Event) {
+	go func() {
+		select {
+		case event := <-events:
+			select {
+			case r.events <- replicationEvent{path: path, children: children, event: event}:
+			case <-r.done:
+			}
+		case <-r.done:
+		}
+	}()
+}
+
+// refresh brings the destination up to date with given source path, arming whichever of its watches is not armed
+func (r *replicator) refresh(path string) error {
+	if err := r.refreshData(path); err != nil {
+		return err
+	}
+	return r.refreshChildren(path)
+}
+
+func (r *replicator) refreshData(path string) error {
+	if r.dataArmed[path] {
+		return nil
+	}
+	data, stat, events, err := r.srcConn.GetW(path)
+	if err == zk.ErrNoNode {
+		return r.remove(path)
+	}
+	if err != nil {
+		return err
+	}
+	r.dataArmed[path] = true
+	r.forward(path, false, events)
+	if stat.EphemeralOwner != 0 {
+		return nil
+	}
+
+	dstPath := r.dstPathOf(path)
+	if _, err := r.dst.setNode(r.dstConn, dstPath, data, -1); err != zk.ErrNoNode {
+		return err
+	}
+	acl, _, err := r.srcConn.GetACL(path)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.dst.createInternalWithACL(r.dstConn, dstPath, data, true, acl, r.dst.autoParentData)
+	return err
+}
+
+func (r *replicator) refreshChildren(path string) error {
+	if r.childrenArmed[path] {
+		return nil
+	}
+	children, _, events, err := r.srcConn.ChildrenW(path)
+	if err == zk.ErrNoNode {
+		return r.remove(path)
+	}
+	if err != nil {
+		return err
+	}
+	r.childrenArmed[path] = true
+	r.forward(path, true, events)
+
+	srcChildren := make(map[string]bool)
+	for _, child := range children {
+		srcChildren[child] = true
+	}
+	dstPath := r.dstPathOf(path)
+	dstChildren, _, err := r.dstConn.Children(dstPath)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	for _, child := range dstChildren {
+		if !srcChildren[child] {
+			if err := r.dst.deleteRecursiveStreamingInternal(r.dstConn, gopath.Join(dstPath, child), make(chan struct{}, maxConcurrency)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, child := range children {
+		if err := r.refresh(gopath.Join(path, child)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the destination of a source path which no longer exists
+func (r *replicator) remove(path string) error {
+	return r.dst.deleteRecursiveStreamingInternal(r.dstConn, r.dstPathOf(path), make(chan struct{}, maxConcurrency))
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"time"
+)
+
+// SetRetryPolicy has requests which fail for a lost connection retried, up to maxAttempts attempts in all, waiting
+// backoff before the first retry and twice as long before each further one. The client library reconnects by
+// itself, possibly in a new session; retries go over the same connection. Retries apply to all writes, and to the
+// reads of single node operations (Get, Exists, Stat, Children and so on, of ZooKeeper and Client). A write whose
+// response was lost may have been applied nonetheless, in which case its retry fails, e.g. with ErrNodeExists, or,
+// for a sequential node, creates another one. Other failures, such as ErrNotFound, are never retried. Defaults to
+// a single attempt.
+func (zook *ZooKeeper) SetRetryPolicy(maxAttempts int, backoff time.Duration) error {
+	if maxAttempts < 1 {
+		return fmt.Errorf("retry attempts must be positive, got %d", maxAttempts)
+	}
+	if backoff < 0 {
+		return fmt.Errorf("retry backoff must not be negative, got %+v", backoff)
+	}
+	zook.retryAttempts, zook.retryBackoff = maxAttempts, backoff
+	return nil
+}
+
+// isRetryable returns whether a request which failed with given error may succeed when issued again
+func isRetryable(err error) bool {
+	return err == zk.ErrConnectionClosed || err == zk.ErrSessionMoved || err == zk.ErrSessionExpired
+}
+
+// retry runs given request, retrying it upon retryable failures as the retry policy allows
+func (zook *ZooKeeper) retry(request func() error) error {
+	backoff := zook.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if !isRetryable(err) || attempt >= zook.retryAttempts {
+			return err
+		}
+		log.Debugf("Request failed: %+v; retrying in %+v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"os"
+)
+
+// SASLConfig identifies the Kerberos principal to authenticate as via SASL/GSSAPI
+type SASLConfig struct {
+	// Principal is the client's Kerberos principal, e.g. "zkcli/host.example.com@EXAMPLE.COM"
+	Principal string
+	// Keytab is the path of a keytab file holding the principal's keys, as exported by kadmin's ktadd; it must
+	// be readable by the process. Empty to rely on the authenticator's credentials cache instead.
+	Keytab string
+	// ServiceName is the primary of the servers' principals, as in "zookeeper/srv-1.example.com@EXAMPLE.COM".
+	// Defaults to "zookeeper", as do the servers.
+	ServiceName string
+}
+
+// SASLAuthenticator performs the SASL exchange for given configuration over a newly established connection
+type SASLAuthenticator func(conn *zk.Conn, config SASLConfig) error
+
+// saslAuth is a SASL configuration along with the authenticator carrying it out
+type saslAuth struct {
+	config       SASLConfig
+	authenticate SASLAuthenticator
+}
+
+// SetSASLConfig has every connection authenticate via SASL, by invoking given authenticator once connected,
+// instead of adding the auth set by SetAuth. The go-zookeeper client we build with implements neither the SASL
+// exchange (the server's sasl request) nor Kerberos, hence the authenticator, provided by the caller, must
+// carry out both, e.g. on top of a client library fork exposing SASL requests. A connection whose authentication
+// fails is not used.
+func (zook *ZooKeeper) SetSASLConfig(config SASLConfig, authenticate SASLAuthenticator) error {
+	if authenticate == nil {
+		return errors.New("SASL requires an authenticator, as the zookeeper client library does not implement it")
+	}
+	if config.Principal == "" {
+		return errors.New("SASL requires a principal")
+	}
+	if config.Keytab != "" {
+		file, err := os.Open(config.Keytab)
+		if err != nil {
+			return fmt.Errorf("cannot read keytab: %+v", err)
+		}
+		file.Close()
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "zookeeper"
+	}
+	zook.sasl = &saslAuth{config: config, authenticate: authenticate}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"io"
+	gopath "path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// shellQuote quotes given string for safe use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// isBinary returns true when given data cannot be passed as a command line argument as is
+func isBinary(data []byte) bool {
+	return !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0
+}
+
+// isSystemPath returns true for ZooKeeper's own /zookeeper tree
+func isSystemPath(path string) bool {
+	return isDescendantOrSelf(path, "/zookeeper")
+}
+
+// ExportAsScript writes a shell script of zookeepercli commands which recreate given path and its descendants,
+// with their data and any non default ACL. ACLs are set once all nodes are created, deepest path first, so that
+// an ACL denying the creation of children does not fail the script. The script expects the target servers in
+// $ZK_SERVERS.
+// Binary data is emitted base64 encoded and decoded into "set" via stdin. Ephemeral nodes are skipped, as are
+// the root node and ZooKeeper's own /zookeeper tree.
+func (zook *ZooKeeper) ExportAsScript(path string, w io.Writer) error {
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	nodes, err := zook.readSubtree(connection, path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	zkcli := `zookeepercli --servers "$ZK_SERVERS"`
+	lines := []string{
+		"#!/bin/sh",
+		fmt.Sprintf("# Recreates %s as exported by zookeepercli", path),
+		"set -e",
+		`: "${ZK_SERVERS:?expecting target servers in ZK_SERVERS}"`,
+	}
+	defaultACL := zk.WorldACL(zk.PermAll)
+	restricted := []string{}
+	restrictedACLs := make(map[string][]zk.ACL)
+	for _, node := range nodes {
+		nodePath := gopath.Join(path, node.relativePath)
+		if nodePath == "/" || isSystemPath(nodePath) {
+			continue
+		}
+		if node.stat.EphemeralOwner != 0 {
+			lines = append(lines, fmt.Sprintf("# skipped ephemeral %s", nodePath))
+			continue
+		}
+		if isBinary(node.data) {
+			lines = append(lines,
+				fmt.Sprintf("%s -c creater %s ''", zkcli, shellQuote(nodePath)),
+				fmt.Sprintf("echo %s | base64 -d | %s -c set %s", shellQuote(base64.StdEncoding.EncodeToString(node.data)), zkcli, shellQuote(nodePath)),
+			)
+		} else {
+			lines = append(lines, fmt.Sprintf("%s -c creater %s %s", zkcli, shellQuote(nodePath), shellQuote(string(node.data))))
+		}
+		if !ACLEqual(node.acl, defaultACL) {
+			restricted = append(restricted, nodePath)
+			restrictedACLs[nodePath] = node.acl
+		}
+	}
+	sort.SliceStable(restricted, func(i, j int) bool {
+		return strings.Count(restricted[i], "/") > strings.Count(restricted[j], "/")
+	})
+	for _, nodePath := range restricted {
+		lines = append(lines, fmt.Sprintf("%s -c setacl %s %s", zkcli, shellQuote(nodePath), shellQuote(strings.Join(zook.aclsToString(restrictedACLs[nodePath]), ","))))
+	}
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
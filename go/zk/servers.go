@@ -0,0 +1,131 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseServersFile parses a servers file: one host or host:port per line, optionally followed by a chroot as
+// with SplitChroot. Blank lines, and anything following a "#", are ignored. It returns the servers and the chroot.
+func parseServersFile(content []byte) ([]string, string, error) {
+	servers := []string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		server := strings.TrimSpace(line)
+		if server == "" {
+			continue
+		}
+		address := server
+		if slash := strings.Index(server, "/"); slash >= 0 {
+			address = server[:slash]
+		}
+		host, port := address, strconv.Itoa(zk.DefaultPort)
+		if strings.Contains(address, ":") {
+			var err error
+			if host, port, err = net.SplitHostPort(address); err != nil {
+				return nil, "", fmt.Errorf("line %d: invalid server %q: %+v", i+1, server, err)
+			}
+		}
+		if host == "" || strings.ContainsAny(host, " \t") {
+			return nil, "", fmt.Errorf("line %d: invalid host in %q", i+1, server)
+		}
+		if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+			return nil, "", fmt.Errorf("line %d: invalid port in %q", i+1, server)
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, "", errors.New("no servers listed")
+	}
+	return SplitChroot(servers)
+}
+
+// LoadServersFromFile sets the list of servers from given file, which lists one host or host:port per line.
+// Blank lines and "#" comments are allowed. Servers may be followed by a chroot, as with --servers, which is
+// returned. The current list is kept if the file is invalid.
+func (zook *ZooKeeper) LoadServersFromFile(path string) (chroot string, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	servers, chroot, err := parseServersFile(content)
+	if err != nil {
+		return "", fmt.Errorf("%s: %+v", path, err)
+	}
+	zook.UpdateServers(servers)
+	return chroot, nil
+}
+
+// WatchServersFile loads the list of servers from given file, then polls the file every interval in the
+// background, reloading the list via UpdateServers whenever its content changes, until stop is closed.
+// A file which fails to load while polling, or which changes the chroot, is logged and ignored, keeping the
+// current list. It returns the chroot of the initial load, and returns with error only if that load fails.
+func (zook *ZooKeeper) WatchServersFile(path string, interval time.Duration, stop <-chan struct{}) (chroot string, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	servers, chroot, err := parseServersFile(content)
+	if err != nil {
+		return "", fmt.Errorf("%s: %+v", path, err)
+	}
+	zook.UpdateServers(servers)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			current, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Errorf("Cannot read servers file %s: %+v", path, err)
+				continue
+			}
+			if bytes.Equal(current, content) {
+				continue
+			}
+			content = current
+			servers, currentChroot, err := parseServersFile(current)
+			if err != nil {
+				log.Errorf("Ignoring servers file %s: %+v", path, err)
+				continue
+			}
+			if currentChroot != chroot {
+				log.Errorf("Ignoring servers file %s: chroot changed from %q to %q", path, chroot, currentChroot)
+				continue
+			}
+			zook.UpdateServers(servers)
+			log.Infof("Reloaded servers from %s: %s", path, strings.Join(servers, ","))
+		}
+	}()
+	return chroot, nil
+}
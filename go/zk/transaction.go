@@ -0,0 +1,167 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Transaction accumulates operations to be applied atomically, all or none, by Commit. It is not safe for
+// concurrent use.
+type Transaction struct {
+	zook *ZooKeeper
+	ops  []interface{}
+	err  error
+}
+
+// TransactionError is returned by Commit when the server rejects the transaction: Index is the position, in
+// submission order, of the operation which failed, Op and Path identify it, and Err is its error.
+type TransactionError struct {
+	Index int
+	Op    string
+	Path  string
+	Err   error
+}
+
+func (err *TransactionError) Error() string {
+	return fmt.Sprintf("transaction rolled back: operation %d, %s %s: %+v", err.Index, err.Op, err.Path, err.Err)
+}
+
+// Unwrap returns the failed operation's error, as an *Error when of a known kind
+func (err *TransactionError) Unwrap() error {
+	return wrapError(err.Path, err.Err)
+}
+
+// NewTransaction returns an empty transaction, to be committed with this ZooKeeper's settings
+func (zook *ZooKeeper) NewTransaction() *Transaction {
+	return &Transaction{zook: zook, ops: []interface{}{}}
+}
+
+// Create adds the creation of given path. aclstr defaults to the ZooKeeper's ACL when empty. Parent directories
+// are not created, unless created by preceding operations of the transaction. An invalid aclstr fails Commit.
+func (txn *Transaction) Create(path string, data []byte, aclstr string) {
+	acl := txn.zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = txn.zook.parseACLString(aclstr); err != nil {
+			if txn.err == nil {
+				txn.err = fmt.Errorf("create %s: %+v", path, err)
+			}
+			return
+		}
+	}
+	txn.ops = append(txn.ops, &zk.CreateRequest{Path: path, Data: data, Acl: acl})
+}
+
+// Set adds the update of given path's data, provided its version is given version; -1 matches any version
+func (txn *Transaction) Set(path string, data []byte, version int32) {
+	txn.ops = append(txn.ops, &zk.SetDataRequest{Path: path, Data: data, Version: version})
+}
+
+// Delete adds the deletion of given path, provided its version is given version; -1 matches any version
+func (txn *Transaction) Delete(path string, version int32) {
+	txn.ops = append(txn.ops, &zk.DeleteRequest{Path: path, Version: version})
+}
+
+// Check adds a requirement that given path be of given version, without modifying it
+func (txn *Transaction) Check(path string, version int32) {
+	txn.ops = append(txn.ops, &zk.CheckVersionRequest{Path: path, Version: version})
+}
+
+// Commit applies the accumulated operations in a single multi request, returning a response per operation, in
+// submission order. Either all operations are applied, or none is: should the server reject any, Commit returns
+// with a *TransactionError identifying it.
+func (txn *Transaction) Commit() ([]zk.MultiResponse, error) {
+	if txn.err != nil {
+		return nil, txn.err
+	}
+	if len(txn.ops) == 0 {
+		return []zk.MultiResponse{}, nil
+	}
+	if len(txn.ops) > maxMultiOps {
+		return nil, fmt.Errorf("transaction of %d operations exceeds the limit of %d", len(txn.ops), maxMultiOps)
+	}
+	connection, err := txn.zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	responses, err := txn.zook.multi(connection, txn.ops...)
+	if failed := transactionFailure(responses); failed >= 0 {
+		return responses, txn.errorAt(failed, responses[failed].Error)
+	}
+	if err != nil {
+		return responses, err
+	}
+	if len(responses) != len(txn.ops) {
+		return responses, errors.New("transaction response does not match its operations")
+	}
+	return responses, nil
+}
+
+// transactionFailure returns the index of the operation which failed a multi request, or -1 if none did.
+// Operations following the failed one, and not executed, respond with a runtime inconsistency, which the client
+// library reports as zk.ErrUnknown.
+func transactionFailure(responses []zk.MultiResponse) int {
+	failed := -1
+	for i, response := range responses {
+		if response.Error == nil {
+			continue
+		}
+		if response.Error != zk.ErrUnknown {
+			return i
+		}
+		if failed < 0 {
+			failed = i
+		}
+	}
+	return failed
+}
+
+// multiOpPath returns the path given multi request operation applies to
+func multiOpPath(op interface{}) string {
+	switch op := op.(type) {
+	case *zk.CreateRequest:
+		return op.Path
+	case *zk.SetDataRequest:
+		return op.Path
+	case *zk.DeleteRequest:
+		return op.Path
+	case *zk.CheckVersionRequest:
+		return op.Path
+	}
+	return ""
+}
+
+// errorAt returns a *TransactionError for the operation at given index
+func (txn *Transaction) errorAt(index int, err error) error {
+	txnErr := &TransactionError{Index: index, Err: err}
+	switch op := txn.ops[index].(type) {
+	case *zk.CreateRequest:
+		txnErr.Op, txnErr.Path = "create", op.Path
+	case *zk.SetDataRequest:
+		txnErr.Op, txnErr.Path = "set", op.Path
+	case *zk.DeleteRequest:
+		txnErr.Op, txnErr.Path = "delete", op.Path
+	case *zk.CheckVersionRequest:
+		txnErr.Op, txnErr.Path = "check", op.Path
+	}
+	return txnErr
+}
@@ -0,0 +1,738 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/samuel/go-zookeeper/zk"
+	gopath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMultiOps bounds the number of operations we are willing to put in a single multi request.
+// ZooKeeper limits a multi by its serialized size (jute.maxbuffer) rather than by op count; this
+// is a conservative figure for reasonably small nodes.
+const maxMultiOps = 1000
+
+// subtreeNode is a single node read off a subtree, with its path relative to the subtree root
+type subtreeNode struct {
+	relativePath string
+	data         []byte
+	acl          []zk.ACL
+	stat         *zk.Stat
+}
+
+// isDescendantOrSelf returns true when path equals ancestor or lies beneath it
+func isDescendantOrSelf(path string, ancestor string) bool {
+	if path == ancestor || ancestor == "/" {
+		return true
+	}
+	return strings.HasPrefix(path, ancestor+"/")
+}
+
+// readSubtree reads data, ACL and stat of given path and all its descendants, in pre-order
+// (every node precedes its descendants).
+func (zook *ZooKeeper) readSubtree(connection *zk.Conn, path string) ([]subtreeNode, error) {
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, err
+	}
+	nodes := []subtreeNode{}
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		data, stat, err := connection.Get(nodePath)
+		if err != nil {
+			return nodes, err
+		}
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(nodePath)
+		if err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, subtreeNode{relativePath: relativePath, data: data, acl: acl, stat: stat})
+	}
+	return nodes, nil
+}
+
+// Rename moves a node, along with all its descendants, to a new path. Data and ACLs are preserved.
+// When the subtree is small enough to fit in a single multi request, the rename is atomic: either
+// the entire subtree appears under newPath and disappears from oldPath, or nothing changes.
+// Larger subtrees fall back to a non-atomic copy-then-delete. The parent of newPath must exist.
+// Ephemeral nodes cannot be renamed.
+func (zook *ZooKeeper) Rename(oldPath string, newPath string) error {
+	if isDescendantOrSelf(newPath, oldPath) {
+		return fmt.Errorf("cannot rename %s to %s: destination is within source", oldPath, newPath)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	nodes, err := zook.readSubtree(connection, oldPath)
+	if err != nil {
+		return wrapError(oldPath, err)
+	}
+	for _, node := range nodes {
+		if node.stat.EphemeralOwner != 0 {
+			return fmt.Errorf("cannot rename %s: %s is ephemeral", oldPath, gopath.Join(oldPath, node.relativePath))
+		}
+	}
+
+	if 2*len(nodes) <= maxMultiOps {
+		log.Infof("Renaming %s to %s atomically (%d nodes)", oldPath, newPath, len(nodes))
+		ops := []interface{}{}
+		for _, node := range nodes {
+			ops = append(ops, &zk.CreateRequest{Path: gopath.Join(newPath, node.relativePath), Data: node.data, Acl: node.acl, Flags: 0})
+		}
+		for i := len(nodes) - 1; i >= 0; i-- {
+			ops = append(ops, &zk.DeleteRequest{Path: gopath.Join(oldPath, nodes[i].relativePath), Version: nodes[i].stat.Version})
+		}
+		responses, err := zook.multi(connection, ops...)
+		if failed := transactionFailure(responses); failed >= 0 {
+			return wrapError(multiOpPath(ops[failed]), responses[failed].Error)
+		}
+		return wrapError(oldPath, err)
+	}
+
+	log.Infof("Renaming %s to %s non-atomically via copy-then-delete (%d nodes exceed multi limit)", oldPath, newPath, len(nodes))
+	for _, node := range nodes {
+		nodePath := gopath.Join(newPath, node.relativePath)
+		if _, err := zook.createNode(connection, nodePath, node.data, 0, node.acl); err != nil {
+			return wrapError(nodePath, err)
+		}
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodePath := gopath.Join(oldPath, nodes[i].relativePath)
+		if err := zook.deleteNode(connection, nodePath, -1); err != nil {
+			return wrapError(nodePath, err)
+		}
+	}
+	return nil
+}
+
+// Move moves a node, along with all its descendants, to destPath, preserving data and ACLs, as Rename does.
+// ZooKeeper has no rename of its own: a subtree fitting in a single multi request is moved atomically, but a
+// larger one is copied, then deleted from sourcePath. Should a move of a large subtree be interrupted, e.g. by the
+// process dying, the copy may be partial, or complete with the source not yet (fully) deleted; readers may see
+// both. Recover by deleting whichever of the two subtrees is incomplete, and moving again if needed.
+func (zook *ZooKeeper) Move(sourcePath string, destPath string) error {
+	return zook.Rename(sourcePath, destPath)
+}
+
+// copyRecursiveInternal: copies given source path and its descendants to destPath, with their ACLs if withACL,
+// else with the default ACL
+func (zook *ZooKeeper) copyRecursiveInternal(sourcePath string, destPath string, force bool, withACL bool) error {
+	if isDescendantOrSelf(destPath, sourcePath) {
+		return fmt.Errorf("cannot copy %s to %s: destination is within source", sourcePath, destPath)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	if exists, _, err := connection.Exists(destPath); err != nil {
+		return wrapError(destPath, err)
+	} else if exists && !force {
+		return fmt.Errorf("cannot copy %s to %s: destination exists", sourcePath, destPath)
+	}
+	nodes, err := zook.readSubtree(connection, sourcePath)
+	if err != nil {
+		return wrapError(sourcePath, err)
+	}
+	if parent := gopath.Dir(destPath); force && parent != "/" {
+		if _, err := zook.createInternal(connection, parent, zook.autoParentData, zook.acl, true, zook.autoParentData); err != nil && err != zk.ErrNodeExists {
+			return wrapError(parent, err)
+		}
+	}
+	for _, node := range nodes {
+		nodePath := gopath.Join(destPath, node.relativePath)
+		if node.stat.EphemeralOwner != 0 {
+			log.Infof("Skipping ephemeral %s", gopath.Join(sourcePath, node.relativePath))
+			continue
+		}
+		acl := zook.acl
+		if withACL {
+			acl = node.acl
+		}
+		_, err := zook.createNode(connection, nodePath, node.data, 0, acl)
+		if err == zk.ErrNodeExists && force {
+			_, err = zook.setNode(connection, nodePath, node.data, -1)
+		}
+		if err == zk.ErrNoNode {
+			// nodes are copied parent first, hence only destPath itself may lack a parent
+			return fmt.Errorf("cannot copy %s to %s: parent of destination does not exist", sourcePath, destPath)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot copy to %s: %w", nodePath, wrapError(nodePath, err))
+		}
+	}
+	return nil
+}
+
+// CopyRecursive copies a node, along with all its descendants, to destPath, preserving their data. Copies get the
+// default ACL; see CopyRecursiveWithACL. It fails if destPath exists, unless force is given, in which case
+// missing parents of destPath are created, and nodes existing under destPath get the data of their source.
+// Ephemeral nodes are not copied. The copy is not atomic; should it fail, the nodes copied thus far remain.
+func (zook *ZooKeeper) CopyRecursive(sourcePath string, destPath string, force bool) error {
+	return zook.copyRecursiveInternal(sourcePath, destPath, force, false)
+}
+
+// CopyRecursiveWithACL is CopyRecursive, with copies getting the ACLs of their sources
+func (zook *ZooKeeper) CopyRecursiveWithACL(sourcePath string, destPath string, force bool) error {
+	return zook.copyRecursiveInternal(sourcePath, destPath, force, true)
+}
+
+// sequenceSuffixLength is the length of the counter ZooKeeper appends to sequential node names
+const sequenceSuffixLength = 10
+
+// sequenceNumber returns the sequence counter of a sequential node's name, and whether the name has one
+func sequenceNumber(name string) (int64, bool) {
+	if len(name) < sequenceSuffixLength {
+		return 0, false
+	}
+	suffix := name[len(name)-sequenceSuffixLength:]
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	sequence, err := strconv.ParseInt(suffix, 10, 64)
+	return sequence, err == nil
+}
+
+// sequenceCounter parses the sequence counter following prefix in a sequential node's name. The counter is a
+// signed 32 bit integer which ZooKeeper formats as %010d: beyond 2147483647 it wraps around to negative values,
+// e.g. "-2147483648", which may be longer than sequenceSuffixLength.
+func sequenceCounter(name string, prefix string) (int32, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	suffix := name[len(prefix):]
+	if len(suffix) < sequenceSuffixLength {
+		return 0, false
+	}
+	counter, err := strconv.ParseInt(suffix, 10, 32)
+	return int32(counter), err == nil
+}
+
+// sequenceGaps returns the counters missing from the contiguous range spanned by given counters. Counters are
+// ordered as ZooKeeper assigns them, hence negative counters, having wrapped around, follow positive ones.
+func sequenceGaps(counters []int32) []int64 {
+	gaps := []int64{}
+	if len(counters) == 0 {
+		return gaps
+	}
+	ordered := make([]uint32, len(counters))
+	for i, counter := range counters {
+		ordered[i] = uint32(counter)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+	for i := 1; i < len(ordered); i++ {
+		for missing := ordered[i-1] + 1; missing < ordered[i]; missing++ {
+			gaps = append(gaps, int64(int32(missing)))
+		}
+	}
+	return gaps
+}
+
+// DetectSequenceGaps lists the sequential children of parent named with given prefix, and returns the sequence
+// counters missing between the lowest and highest of them, e.g. consumed queue items or failed creates.
+// Children not named prefix followed by a counter are ignored.
+func (zook *ZooKeeper) DetectSequenceGaps(parent string, prefix string) ([]int64, error) {
+	children, err := zook.Children(parent)
+	if err != nil {
+		return nil, err
+	}
+	counters := []int32{}
+	for _, child := range children {
+		if counter, ok := sequenceCounter(child, prefix); ok {
+			counters = append(counters, counter)
+		}
+	}
+	return sequenceGaps(counters), nil
+}
+
+// ArchiveOldChildren moves all but the keepRecent most recent children of given path (along with their
+// descendants) under archivePath, which is created if missing. Children are ordered by their sequence
+// number when all are sequential, and by modification time otherwise. Leaf children are moved in
+// batches of atomic multi requests; children with descendants are moved via Rename. Ephemeral
+// children cannot be moved and are skipped. Returns the number of children archived, which, should archiving
+// fail, is the number archived up to the failure.
+func (zook *ZooKeeper) ArchiveOldChildren(path string, keepRecent int, archivePath string) (int, error) {
+	if keepRecent < 0 {
+		return 0, fmt.Errorf("invalid number of children to keep: %d", keepRecent)
+	}
+	if isDescendantOrSelf(archivePath, path) && gopath.Dir(archivePath) != path {
+		return 0, fmt.Errorf("cannot archive %s into %s: archive must be outside or a direct child", path, archivePath)
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	children, _, err := connection.Children(path)
+	if err != nil {
+		return 0, wrapError(path, err)
+	}
+	type child struct {
+		name string
+		stat *zk.Stat
+		err  error
+	}
+	candidates := []child{}
+	for _, name := range children {
+		if gopath.Join(path, name) != archivePath {
+			candidates = append(candidates, child{name: name})
+		}
+	}
+	if len(candidates) <= keepRecent {
+		log.Infof("%s has %d children, nothing to archive", path, len(candidates))
+		return 0, nil
+	}
+	var mutex sync.Mutex
+	forEachConcurrently(len(candidates), func(i int) {
+		zook.throttle(1)
+		_, stat, err := connection.Exists(gopath.Join(path, candidates[i].name))
+		mutex.Lock()
+		defer mutex.Unlock()
+		candidates[i].stat, candidates[i].err = stat, err
+	})
+	allSequential := true
+	for _, c := range candidates {
+		if c.err != nil {
+			return 0, wrapError(gopath.Join(path, c.name), c.err)
+		}
+		if _, ok := sequenceNumber(c.name); !ok {
+			allSequential = false
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if allSequential {
+			si, _ := sequenceNumber(candidates[i].name)
+			sj, _ := sequenceNumber(candidates[j].name)
+			return si < sj
+		}
+		if candidates[i].stat.Mtime != candidates[j].stat.Mtime {
+			return candidates[i].stat.Mtime < candidates[j].stat.Mtime
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	if exists, _, err := connection.Exists(archivePath); err != nil {
+		return 0, wrapError(archivePath, err)
+	} else if !exists {
+		if _, err := zook.createInternal(connection, archivePath, []byte{}, zook.acl, true, zook.autoParentData); err != nil {
+			return 0, wrapError(archivePath, err)
+		}
+	}
+
+	archived := 0
+	ops := []interface{}{}
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		if responses, err := zook.multi(connection, ops...); err != nil {
+			if failed := transactionFailure(responses); failed >= 0 {
+				return wrapError(multiOpPath(ops[failed]), responses[failed].Error)
+			}
+			return wrapError(archivePath, err)
+		}
+		archived += len(ops) / 2
+		ops = []interface{}{}
+		return nil
+	}
+	for _, c := range candidates[:len(candidates)-keepRecent] {
+		childPath := gopath.Join(path, c.name)
+		if c.stat.EphemeralOwner != 0 {
+			log.Warningf("Skipping ephemeral %s", childPath)
+			continue
+		}
+		if c.stat.NumChildren > 0 {
+			if err := zook.Rename(childPath, gopath.Join(archivePath, c.name)); err != nil {
+				return archived, err
+			}
+			archived++
+			continue
+		}
+		zook.throttle(1)
+		data, stat, err := connection.Get(childPath)
+		if err != nil {
+			return archived, wrapError(childPath, err)
+		}
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(childPath)
+		if err != nil {
+			return archived, wrapError(childPath, err)
+		}
+		ops = append(ops,
+			&zk.CreateRequest{Path: gopath.Join(archivePath, c.name), Data: data, Acl: acl, Flags: 0},
+			&zk.DeleteRequest{Path: childPath, Version: stat.Version},
+		)
+		if len(ops)+2 > maxMultiOps {
+			if err := flush(); err != nil {
+				return archived, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return archived, err
+	}
+	log.Infof("Archived %d children of %s into %s", archived, path, archivePath)
+	return archived, nil
+}
+
+// SetTagged sets given data on given path and each of its descendants whose current data satisfies tagPredicate.
+// Each node is set conditionally on the version its data was read at, so that a node modified concurrently is
+// not overwritten. It carries on past per node failures, returning the number of nodes set and a MultiError
+// listing the failures.
+func (zook *ZooKeeper) SetTagged(path string, data []byte, tagPredicate func(data []byte) bool) (int, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return 0, wrapError(path, err)
+	}
+	count := 0
+	errs := MultiError{}
+	for _, relativePath := range append([]string{""}, descendants...) {
+		nodePath := gopath.Join(path, relativePath)
+		zook.throttle(1)
+		current, stat, err := connection.Get(nodePath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodePath, wrapError(nodePath, err)))
+			continue
+		}
+		if !tagPredicate(current) {
+			continue
+		}
+		if _, err := zook.setNode(connection, nodePath, data, stat.Version); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodePath, wrapError(nodePath, err)))
+			continue
+		}
+		count++
+	}
+	return count, errs.errorOrNil()
+}
+
+// CreatePlanned creates all given paths with their data, as one planned operation: it first checks which target
+// paths already exist and which of their parents are missing, logs the plan, and only then writes. Should any target
+// exist, it fails before writing anything, unless force is given, in which case existing targets have their data set.
+// Missing parents are created with the auto-generated marker. Nodes are created in dependency order. This is not
+// atomic: a failure midway leaves the nodes created so far in place.
+func (zook *ZooKeeper) CreatePlanned(paths map[string][]byte, aclstr string, force bool) error {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	// Every target and every ancestor thereof
+	checkPaths := []string{}
+	isChecked := make(map[string]bool)
+	for path := range paths {
+		for ancestor := path; ancestor != "/" && !isChecked[ancestor]; ancestor = gopath.Dir(ancestor) {
+			isChecked[ancestor] = true
+			checkPaths = append(checkPaths, ancestor)
+		}
+	}
+	exists := make([]bool, len(checkPaths))
+	errs := make([]error, len(checkPaths))
+	forEachConcurrently(len(checkPaths), func(i int) {
+		zook.throttle(1)
+		exists[i], _, errs[i] = connection.Exists(checkPaths[i])
+	})
+
+	existingTargets := []string{}
+	toCreate := []string{}
+	for i, path := range checkPaths {
+		if errs[i] != nil {
+			return wrapError(path, errs[i])
+		}
+		_, isTarget := paths[path]
+		if exists[i] && isTarget {
+			existingTargets = append(existingTargets, path)
+		}
+		if !exists[i] {
+			toCreate = append(toCreate, path)
+		}
+	}
+	// Lexical order places every node before its descendants
+	sort.Strings(existingTargets)
+	sort.Strings(toCreate)
+	log.Infof("Planned create: %d nodes to create (%d of which are parents), %d existing targets", len(toCreate), len(toCreate)-(len(paths)-len(existingTargets)), len(existingTargets))
+	if len(existingTargets) > 0 && !force {
+		return fmt.Errorf("%d target paths already exist: %s", len(existingTargets), strings.Join(existingTargets, ", "))
+	}
+
+	for _, path := range toCreate {
+		data, isTarget := paths[path]
+		if !isTarget {
+			data = zook.autoParentData
+		}
+		if _, err := zook.createNode(connection, path, data, zook.flags, acl); err != nil {
+			return wrapError(path, err)
+		}
+	}
+	for _, path := range existingTargets {
+		if _, err := zook.setNode(connection, path, paths[path], -1); err != nil {
+			return wrapError(path, err)
+		}
+	}
+	return nil
+}
+
+// initializedGuardName is the child of a root whose existence tells InitializeOnce the root was initialized
+const initializedGuardName = ".initialized"
+
+// InitializeOnce populates root with given tree, keyed by path relative to root, unless root was already
+// initialized; it returns whether this call initialized it. Of any number of concurrent callers, exactly one
+// initializes: the one which creates the guard node root/.initialized. Root is created as needed, and missing
+// parents within the tree are created with the auto-generated marker. The guard and the tree are created in a
+// single transaction, so that a failure leaves root uninitialized. Trees too large for a single transaction
+// are created after the guard, and a failure midway leaves a partial tree behind a guard.
+func (zook *ZooKeeper) InitializeOnce(root string, initialTree map[string][]byte, aclstr string) (bool, error) {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return false, err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	guardPath := gopath.Join(root, initializedGuardName)
+	if exists, _, err := connection.Exists(guardPath); err != nil {
+		return false, wrapError(guardPath, err)
+	} else if exists {
+		return false, nil
+	}
+	if _, err := zook.createInternalWithACL(connection, root, []byte{}, true, acl, zook.autoParentData); err != nil && err != zk.ErrNodeExists {
+		return false, wrapError(root, err)
+	}
+
+	// Every node of the tree and every ancestor thereof under root
+	paths := []string{}
+	isPlanned := make(map[string]bool)
+	for relativePath := range initialTree {
+		path := gopath.Join(root, relativePath)
+		for ancestor := path; ancestor != root && !isPlanned[ancestor]; ancestor = gopath.Dir(ancestor) {
+			if !isDescendantOrSelf(ancestor, root) {
+				return false, fmt.Errorf("%s is not under %s", relativePath, root)
+			}
+			isPlanned[ancestor] = true
+			paths = append(paths, ancestor)
+		}
+	}
+	// Lexical order places every node before its descendants
+	sort.Strings(paths)
+	guardData := []byte(time.Now().UTC().Format(time.RFC3339))
+	ops := []interface{}{&zk.CreateRequest{Path: guardPath, Data: guardData, Acl: acl, Flags: 0}}
+	for _, path := range paths {
+		data, ok := initialTree[strings.TrimPrefix(strings.TrimPrefix(path, root), "/")]
+		if !ok {
+			data = zook.autoParentData
+		}
+		ops = append(ops, &zk.CreateRequest{Path: path, Data: data, Acl: acl, Flags: 0})
+	}
+
+	if len(ops) <= maxMultiOps {
+		if responses, err := zook.multi(connection, ops...); err != nil {
+			if exists, _, existsErr := connection.Exists(guardPath); existsErr == nil && exists {
+				return false, nil
+			}
+			if failed := transactionFailure(responses); failed >= 0 {
+				return false, wrapError(multiOpPath(ops[failed]), responses[failed].Error)
+			}
+			return false, wrapError(root, err)
+		}
+		return true, nil
+	}
+	log.Warningf("%d nodes exceed a single transaction; initializing %s non-atomically", len(ops), root)
+	for i, op := range ops {
+		create := op.(*zk.CreateRequest)
+		if _, err := zook.createNode(connection, create.Path, create.Data, create.Flags, create.Acl); err != nil {
+			if i == 0 && err == zk.ErrNodeExists {
+				return false, nil
+			}
+			return i > 0, wrapError(create.Path, err)
+		}
+	}
+	return true, nil
+}
+
+// CleanupByMarker deletes given path and any of its descendants whose data equals given ownership marker, e.g. an
+// instance id written by a process which has since crashed. Nodes are deleted deepest first; a marked node which
+// still has unmarked children is not deleted, and is reported in the returned MultiError as of kind ErrNotEmpty,
+// with dryRun as well. With dryRun nothing is deleted. Returns the paths which were (or, with dryRun, would be) deleted.
+func (zook *ZooKeeper) CleanupByMarker(path string, marker []byte, dryRun bool) ([]string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	descendants, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	nodePaths := append([]string{path}, descendants...)
+	for i := range descendants {
+		nodePaths[i+1] = gopath.Join(path, descendants[i])
+	}
+	deleted := []string{}
+	errs := MultiError{}
+	// Parents which keep children, whether unmarked or failing to be deleted, and so cannot be deleted either
+	keepsChildren := make(map[string]bool)
+	for i := len(nodePaths) - 1; i >= 0; i-- {
+		zook.throttle(1)
+		data, stat, err := connection.Get(nodePaths[i])
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err == nil && bytes.Equal(data, marker) && keepsChildren[nodePaths[i]] {
+			err = zk.ErrNotEmpty
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodePaths[i], wrapError(nodePaths[i], err)))
+			keepsChildren[gopath.Dir(nodePaths[i])] = true
+			continue
+		}
+		if !bytes.Equal(data, marker) {
+			keepsChildren[gopath.Dir(nodePaths[i])] = true
+			continue
+		}
+		if dryRun {
+			log.Infof("Would delete %s", nodePaths[i])
+		} else if err := zook.deleteNode(connection, nodePaths[i], stat.Version); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodePaths[i], wrapError(nodePaths[i], err)))
+			keepsChildren[gopath.Dir(nodePaths[i])] = true
+			continue
+		}
+		deleted = append(deleted, nodePaths[i])
+	}
+	return deleted, errs.errorOrNil()
+}
+
+// deleteRecursiveStreamingInternal: deletes descendants of given path depth first, then the path itself. Subtrees
+// are handed off to concurrent goroutines while free slots remain, and are otherwise deleted inline, so that no
+// more than cap(slots) goroutines are ever spawned and the recursion never blocks waiting for a slot. Refuses the
+// root, which would otherwise be emptied of everything.
+func (zook *ZooKeeper) deleteRecursiveStreamingInternal(connection *zk.Conn, path string, slots chan struct{}) error {
+	if path == "/" {
+		return errDeleteRoot
+	}
+	zook.throttle(1)
+	children, _, err := connection.Children(path)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return wrapError(path, err)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	recordErr := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+	for _, child := range children {
+		if failed() {
+			break
+		}
+		childPath := gopath.Join(path, child)
+		select {
+		case slots <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if err := zook.deleteRecursiveStreamingInternal(connection, childPath, slots); err != nil {
+					recordErr(err)
+				}
+			}()
+		default:
+			if err := zook.deleteRecursiveStreamingInternal(connection, childPath, slots); err != nil {
+				recordErr(err)
+			}
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := zook.deleteNode(connection, path, -1); err != nil && err != zk.ErrNoNode {
+		return wrapError(path, err)
+	}
+	return nil
+}
+
+// DeleteRecursiveStreaming deletes given path and all its descendants, like DeleteRecursive, without first listing
+// the entire subtree: it walks the tree depth first and deletes nodes as it unwinds, so that memory does not grow
+// with the size of the tree. Independent subtrees are deleted concurrently. The first error stops the deletion
+// and is returned; nodes deleted up to that point remain deleted. The root cannot be deleted.
+func (zook *ZooKeeper) DeleteRecursiveStreaming(path string) error {
+	if path == "/" {
+		return errDeleteRoot
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	if exists, _, err := connection.Exists(path); err != nil {
+		return wrapError(path, err)
+	} else if !exists {
+		return wrapError(path, zk.ErrNoNode)
+	}
+	return wrapError(path, zook.deleteRecursiveStreamingInternal(connection, path, make(chan struct{}, maxConcurrency)))
+}
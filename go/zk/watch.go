@@ -0,0 +1,119 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zk
+
+import (
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"io"
+	"sort"
+	"time"
+)
+
+// WaitForNoChildren blocks until given path has no children, or until timeout elapses. It returns true when
+// the path was found to have no children, including when the path does not exist (or gets deleted), and false
+// on timeout. Useful to wait for ephemeral children (e.g. registered workers) to go away.
+func (zook *ZooKeeper) WaitForNoChildren(path string, timeout time.Duration) (bool, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	deadline := time.After(timeout)
+	for {
+		children, _, events, err := connection.ChildrenW(path)
+		if err == zk.ErrNoNode {
+			return true, nil
+		}
+		if err != nil {
+			return false, wrapError(path, err)
+		}
+		if len(children) == 0 {
+			return true, nil
+		}
+		select {
+		case event := <-events:
+			if event.Err != nil {
+				return false, event.Err
+			}
+		case <-deadline:
+			return false, nil
+		}
+	}
+}
+
+// TailChildren watches given path's children, writing a "+child" line per child added and a "-child" line per
+// child removed, as they happen. Children present at start are not listed. Changes in between two watch
+// notifications are coalesced by ZooKeeper, so a child added and removed in quick succession may go unnoticed.
+// When the path is deleted, a "!path" line is written and TailChildren returns nil; otherwise it runs until an
+// error occurs, e.g. loss of session.
+func (zook *ZooKeeper) TailChildren(path string, w io.Writer) error {
+	connection, err := zook.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	children, _, events, err := connection.ChildrenW(path)
+	if err != nil {
+		return wrapError(path, err)
+	}
+	for {
+		event := <-events
+		if event.Err != nil {
+			return event.Err
+		}
+		current, _, nextEvents, err := connection.ChildrenW(path)
+		if err == zk.ErrNoNode {
+			_, err := fmt.Fprintf(w, "!%s\n", path)
+			return err
+		}
+		if err != nil {
+			return wrapError(path, err)
+		}
+		if err := writeChildrenDelta(w, children, current); err != nil {
+			return err
+		}
+		children, events = current, nextEvents
+	}
+}
+
+// writeChildrenDelta writes "+child" and "-child" lines for the children added and removed between given lists
+func writeChildrenDelta(w io.Writer, previous []string, current []string) error {
+	delta := []string{}
+	previousSet := make(map[string]bool)
+	for _, child := range previous {
+		previousSet[child] = true
+	}
+	for _, child := range current {
+		if !previousSet[child] {
+			delta = append(delta, "+"+child)
+		}
+		delete(previousSet, child)
+	}
+	for child := range previousSet {
+		delta = append(delta, "-"+child)
+	}
+	sort.Strings(delta)
+	for _, line := range delta {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -19,32 +19,70 @@ package zk
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/outbrain/golib/log"
 	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
 	"math"
+	"net/url"
 	gopath "path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// defaultAutoParentData is the data of parent nodes created by a forced create, unless set otherwise
+const defaultAutoParentData = "zookeepercli auto-generated"
+
+// defaultSessionTimeout is the session timeout requested upon connecting, unless set otherwise
+const defaultSessionTimeout = time.Second
+
+// maxConcurrency bounds the number of concurrent requests bulk operations issue over a single connection
+const maxConcurrency = 16
+
 type ZooKeeper struct {
+	// servers may be replaced while in use (see WatchServersFile), hence is guarded by serversMutex
 	servers        []string
+	serversMutex   sync.RWMutex
 	authScheme     string
 	authExpression []byte
 
 	// We assume complete access to all
 	flags int32
 	acl   []zk.ACL
+
+	worldWritablePerms     int32
+	auditFunc              func(op string, path string, err error)
+	skipUnreachableServers bool
+	updateAttempts         int
+	rateLimiter            *tokenBucket
+	initialVersion         int64
+	sessionTimeout         time.Duration
+	proxy                  *url.URL
+	tlsConfig              *tls.Config
+	sasl                   *saslAuth
+	autoParentData         []byte
+	retryAttempts          int
+	retryBackoff           time.Duration
+	inheritParentACL       bool
 }
 
 func NewZooKeeper() *ZooKeeper {
 	return &ZooKeeper{
-		flags: int32(0),
-		acl:   zk.WorldACL(zk.PermAll),
+		flags:              int32(0),
+		acl:                zk.WorldACL(zk.PermAll),
+		worldWritablePerms: zk.PermWrite | zk.PermCreate | zk.PermDelete | zk.PermAdmin,
+		updateAttempts:     5,
+		initialVersion:     1,
+		sessionTimeout:     defaultSessionTimeout,
+		autoParentData:     []byte(defaultAutoParentData),
+		retryAttempts:      1,
 	}
 }
 
@@ -52,10 +90,99 @@ func NewZooKeeper() *ZooKeeper {
 // Each element in the array should be in either of following forms:
 // - "servername"
 // - "servername:port"
+// A chroot suffix, as in "servername:port/chroot", is not supported by the client library, and fails connections;
+// split it off with SplitChroot.
 func (zook *ZooKeeper) SetServers(serversArray []string) {
+	zook.serversMutex.Lock()
+	defer zook.serversMutex.Unlock()
 	zook.servers = serversArray
 }
 
+// UpdateServers replaces the list of servers. Connections made afterwards use the new list; existing
+// connections, such as of a running watch, are unaffected.
+func (zook *ZooKeeper) UpdateServers(serversArray []string) {
+	zook.SetServers(serversArray)
+}
+
+// getServers returns the current list of servers
+func (zook *ZooKeeper) getServers() []string {
+	zook.serversMutex.RLock()
+	defer zook.serversMutex.RUnlock()
+	return zook.servers
+}
+
+// SplitChroot splits a chroot suffix off given servers, as in "zk1:2181/app,zk2:2181/app", returning the servers
+// without it, along with the chroot ("/app"), or "" if none is given. As in ZooKeeper's connection strings, the
+// chroot may also be given once, on the last server ("zk1:2181,zk2:2181/app"). Servers giving different chroots
+// are refused. The client library knows nothing of chroots, so callers are to prefix paths with the chroot
+// themselves, as the command line tool does.
+func SplitChroot(servers []string) ([]string, string, error) {
+	result := make([]string, len(servers))
+	chroot := ""
+	for i, server := range servers {
+		result[i] = server
+		slash := strings.Index(server, "/")
+		if slash < 0 {
+			continue
+		}
+		result[i] = server[:slash]
+		serverChroot := gopath.Clean(server[slash:])
+		if serverChroot == "/" {
+			continue
+		}
+		if chroot != "" && serverChroot != chroot {
+			return nil, "", fmt.Errorf("servers give different chroots: %s, %s", chroot, serverChroot)
+		}
+		chroot = serverChroot
+	}
+	return result, chroot, nil
+}
+
+// SetAutoParentData sets the data of the parent nodes created along with a node, i.e. the auto-generated marker,
+// which defaults to "zookeepercli auto-generated". Tools which take any node with data for configuration may have
+// parents created empty, with nil.
+func (zook *ZooKeeper) SetAutoParentData(data []byte) {
+	if data == nil {
+		data = []byte{}
+	}
+	zook.autoParentData = data
+}
+
+// SetInheritParentACL, when true, has the parent nodes created along with a node get the ACL of their nearest
+// existing ancestor, rather than the node's own ACL, so that forcing a path into a restricted subtree does not
+// leave more permissive nodes in it. Defaults to false.
+func (zook *ZooKeeper) SetInheritParentACL(inherit bool) {
+	zook.inheritParentACL = inherit
+}
+
+// SetSkipUnreachableServers, when true, has connections probe the servers first and only connect to those
+// which respond, logging the unreachable ones. Should none respond, all servers are used.
+func (zook *ZooKeeper) SetSkipUnreachableServers(skip bool) {
+	zook.skipUnreachableServers = skip
+}
+
+// SetUpdateAttempts sets the number of read-modify-write cycles Update attempts before giving up on
+// concurrent modifications. Defaults to 5.
+func (zook *ZooKeeper) SetUpdateAttempts(attempts int) {
+	zook.updateAttempts = attempts
+}
+
+// SetSessionTimeout sets the session timeout requested upon connecting, which also bounds connection attempts
+// and server probes. The server may negotiate it into its configured bounds. A short timeout makes ephemeral
+// nodes expire upon brief network or server hiccups. Defaults to one second.
+func (zook *ZooKeeper) SetSessionTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("session timeout must be positive, got %+v", timeout)
+	}
+	zook.sessionTimeout = timeout
+	return nil
+}
+
+// SetInitialVersion sets the value BumpVersion creates a missing version node with. Defaults to 1.
+func (zook *ZooKeeper) SetInitialVersion(initial int64) {
+	zook.initialVersion = initial
+}
+
 func (zook *ZooKeeper) SetAuth(scheme string, auth []byte) {
 	log.Debug("Setting Auth ")
 	zook.authScheme = scheme
@@ -76,6 +203,51 @@ func (zook *ZooKeeper) BuildACL(authScheme string, user string, pwd string, acls
 	return perms, err
 }
 
+// MultiError collects the errors of a bulk operation which carries on past individual failures
+type MultiError []error
+
+func (errs MultiError) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d errors: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the collected errors, so that errors.Is and errors.As match any of them
+func (errs MultiError) Unwrap() []error {
+	return errs
+}
+
+// errorOrNil returns given errors as a MultiError, or nil if there are none
+func (errs MultiError) errorOrNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// forEachConcurrently runs f(0)...f(count-1), running at most maxConcurrency of them at any time
+func forEachConcurrently(count int, f func(i int)) {
+	forEachWithConcurrency(count, maxConcurrency, f)
+}
+
+// forEachWithConcurrency runs f(0)...f(count-1), running at most concurrency of them at any time
+func forEachWithConcurrency(count int, concurrency int, f func(i int)) {
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 type infoLogger struct{}
 
 func (_ infoLogger) Printf(format string, a ...interface{}) {
@@ -84,38 +256,391 @@ func (_ infoLogger) Printf(format string, a ...interface{}) {
 
 // connect
 func (zook *ZooKeeper) connect() (*zk.Conn, error) {
+	conn, _, err := zook.connectWithEvents()
+	return conn, err
+}
+
+// logSessionEvent logs changes of a connection's session state
+func logSessionEvent(event zk.Event) {
+	if event.Type != zk.EventSession {
+		return
+	}
+	if event.State == zk.StateExpired {
+		log.Warningf("Session expired (server %s)", event.Server)
+	} else {
+		log.Infof("Session state: %s (server %s)", event.State, event.Server)
+	}
+}
+
+// connectWithEvents connects, returning the connection's channel of session events along with it
+func (zook *ZooKeeper) connectWithEvents() (*zk.Conn, <-chan zk.Event, error) {
 	zk.DefaultLogger = &infoLogger{}
-	conn, _, err := zk.Connect(zook.servers, time.Second)
-	if err == nil && zook.authScheme != "" {
+	servers := zook.getServers()
+	for _, server := range servers {
+		if strings.Contains(server, "/") {
+			return nil, nil, fmt.Errorf("server %s: chroot is unsupported by the client library; see SplitChroot", server)
+		}
+	}
+	if zook.skipUnreachableServers {
+		reachable, unreachable := zook.ProbeServers()
+		if len(unreachable) > 0 {
+			log.Warningf("Unreachable servers: %s", strings.Join(unreachable, ","))
+		}
+		if len(reachable) > 0 {
+			servers = reachable
+		} else {
+			log.Warning("No server is reachable; will attempt all")
+		}
+	}
+	var conn *zk.Conn
+	var events <-chan zk.Event
+	var err error
+	if zook.proxy != nil {
+		conn, events, err = zk.Connect(servers, zook.sessionTimeout, zk.WithEventCallback(logSessionEvent), zk.WithDialer(zook.dial), zk.WithHostProvider(&staticHostProvider{}))
+	} else if zook.tlsConfig != nil {
+		conn, events, err = zk.Connect(servers, zook.sessionTimeout, zk.WithEventCallback(logSessionEvent), zk.WithDialer(zook.dial))
+	} else {
+		conn, events, err = zk.Connect(servers, zook.sessionTimeout, zk.WithEventCallback(logSessionEvent))
+	}
+	if err == nil && zook.sasl != nil {
+		log.Debugf("SASL authentication as %s", zook.sasl.config.Principal)
+		if err = zook.sasl.authenticate(conn, zook.sasl.config); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("SASL authentication as %s: %+v", zook.sasl.config.Principal, err)
+		}
+	} else if err == nil && zook.authScheme != "" {
 		log.Debugf("Add Auth %s %s", zook.authScheme, zook.authExpression)
 		err = conn.AddAuth(zook.authScheme, zook.authExpression)
 	}
 
-	return conn, err
+	return conn, events, err
+}
+
+// SetAuditFunc sets a function to be invoked after every mutating operation on a node, with the
+// operation type ("create", "set", "delete", "setacl"), the node's path and the operation's result.
+// Recursive operations invoke it once per affected node.
+func (zook *ZooKeeper) SetAuditFunc(auditFunc func(op string, path string, err error)) {
+	zook.auditFunc = auditFunc
+}
+
+func (zook *ZooKeeper) audit(op string, path string, err error) {
+	if zook.auditFunc != nil {
+		zook.auditFunc(op, path, err)
+	}
+}
+
+// createNode: create a single node, audited
+func (zook *ZooKeeper) createNode(connection *zk.Conn, path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	var createdPath string
+	err := zook.retry(func() (err error) {
+		zook.throttle(1)
+		createdPath, err = connection.Create(path, data, flags, acl)
+		return err
+	})
+	zook.audit("create", path, err)
+	return createdPath, err
+}
+
+// setNode: set data of a single node, audited
+func (zook *ZooKeeper) setNode(connection *zk.Conn, path string, data []byte, version int32) (*zk.Stat, error) {
+	var stat *zk.Stat
+	err := zook.retry(func() (err error) {
+		zook.throttle(1)
+		stat, err = connection.Set(path, data, version)
+		return err
+	})
+	zook.audit("set", path, err)
+	return stat, err
+}
+
+// setNodeACL: set ACL of a single node, audited
+func (zook *ZooKeeper) setNodeACL(connection *zk.Conn, path string, acl []zk.ACL, version int32) (*zk.Stat, error) {
+	var stat *zk.Stat
+	err := zook.retry(func() (err error) {
+		zook.throttle(1)
+		stat, err = connection.SetACL(path, acl, version)
+		return err
+	})
+	zook.audit("setacl", path, err)
+	return stat, err
+}
+
+// deleteNode: delete a single node, audited
+func (zook *ZooKeeper) deleteNode(connection *zk.Conn, path string, version int32) error {
+	err := zook.retry(func() error {
+		zook.throttle(1)
+		return connection.Delete(path, version)
+	})
+	zook.audit("delete", path, err)
+	return err
+}
+
+// multi: issue a multi request, auditing each of its operations
+func (zook *ZooKeeper) multi(connection *zk.Conn, ops ...interface{}) ([]zk.MultiResponse, error) {
+	var responses []zk.MultiResponse
+	err := zook.retry(func() (err error) {
+		zook.throttle(len(ops))
+		responses, err = connection.Multi(ops...)
+		return err
+	})
+	for i, op := range ops {
+		opErr := err
+		if i < len(responses) && responses[i].Error != nil {
+			opErr = responses[i].Error
+		}
+		switch op := op.(type) {
+		case *zk.CreateRequest:
+			zook.audit("create", op.Path, opErr)
+		case *zk.SetDataRequest:
+			zook.audit("set", op.Path, opErr)
+		case *zk.DeleteRequest:
+			zook.audit("delete", op.Path, opErr)
+		}
+	}
+	return responses, err
 }
 
 // Exists returns true when the given path exists
 func (zook *ZooKeeper) Exists(path string) (bool, error) {
-	connection, err := zook.connect()
+	client, err := zook.NewClient()
 	if err != nil {
 		return false, err
 	}
+	defer client.Close()
+
+	return client.Exists(path)
+}
+
+// ExistsMany checks existence of all given paths, concurrently, over a single connection, returning existence per
+// path. A failure to connect is returned as is; paths which could not be checked are omitted from the result, and
+// their failures returned in a MultiError, along with the existence of the paths which were checked.
+func (zook *ZooKeeper) ExistsMany(paths []string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	connection, err := zook.connect()
+	if err != nil {
+		return result, err
+	}
 	defer connection.Close()
 
-	exists, _, err := connection.Exists(path)
-	return exists, err
+	errs := MultiError{}
+	var mutex sync.Mutex
+	forEachConcurrently(len(paths), func(i int) {
+		zook.throttle(1)
+		exists, _, err := connection.Exists(paths[i])
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", paths[i], wrapError(paths[i], err)))
+		} else {
+			result[paths[i]] = exists
+		}
+	})
+	return result, errs.errorOrNil()
+}
+
+// GetMany reads the data of all given paths, concurrently, over a single connection, returning it per path.
+// Paths which do not exist are omitted from the result; other per path failures are returned in a MultiError,
+// along with the data of the paths which were read.
+func (zook *ZooKeeper) GetMany(paths []string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	connection, err := zook.connect()
+	if err != nil {
+		return result, err
+	}
+	defer connection.Close()
+
+	errs := MultiError{}
+	var mutex sync.Mutex
+	forEachConcurrently(len(paths), func(i int) {
+		zook.throttle(1)
+		data, _, err := connection.Get(paths[i])
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == zk.ErrNoNode {
+			return
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", paths[i], wrapError(paths[i], err)))
+		} else {
+			result[paths[i]] = data
+		}
+	})
+	return result, errs.errorOrNil()
+}
+
+// ValidateSchema checks that all required paths exist under root, and that none of the forbidden ones do.
+// Both lists are relative to root. Returns the violations, as "missing: <path>" or "forbidden: <path>".
+func (zook *ZooKeeper) ValidateSchema(root string, required []string, forbidden []string) ([]string, error) {
+	paths := []string{}
+	for _, relativePath := range append(append([]string{}, required...), forbidden...) {
+		paths = append(paths, gopath.Join(root, relativePath))
+	}
+	exists, err := zook.ExistsMany(paths)
+	if err != nil {
+		return nil, err
+	}
+	violations := []string{}
+	for i, path := range paths {
+		if i < len(required) && !exists[path] {
+			violations = append(violations, fmt.Sprintf("missing: %s", path))
+		}
+		if i >= len(required) && exists[path] {
+			violations = append(violations, fmt.Sprintf("forbidden: %s", path))
+		}
+	}
+	return violations, nil
 }
 
 // Get returns value associated with given path, or error if path does not exist
 func (zook *ZooKeeper) Get(path string) ([]byte, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return []byte{}, err
+	}
+	defer client.Close()
+
+	return client.Get(path)
+}
+
+// Sync has the server connected to catch up with the leader on given path. As reads are served by the server a
+// client is connected to, which may lag behind, a read on the same connection following a sync observes all
+// writes committed before it. Since each ZooKeeper call connects anew, use GetAfterSync, or a Client's Sync
+// followed by reads on the same Client, rather than Sync followed by Get.
+func (zook *ZooKeeper) Sync(path string) error {
+	client, err := zook.NewClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Sync(path)
+}
+
+// GetAfterSync returns value associated with given path, up to date as of the call rather than possibly stale,
+// or error if path does not exist. It costs a round trip to the leader more than Get.
+func (zook *ZooKeeper) GetAfterSync(path string) ([]byte, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.GetAfterSync(path)
+}
+
+// Stat returns the metadata of given path (versions, zxids, data length, children count, ephemeral owner, etc.),
+// or an error of kind ErrNotFound if path does not exist
+func (zook *ZooKeeper) Stat(path string) (*zk.Stat, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.Stat(path)
+}
+
+// GetWithStat returns value associated with given path along with its metadata, read in one request
+func (zook *ZooKeeper) GetWithStat(path string) ([]byte, *zk.Stat, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	return client.GetWithStat(path)
+}
+
+// DataTooLargeError is returned by GetLimited when a node's data exceeds the limit
+type DataTooLargeError struct {
+	Path  string
+	Limit int
+	Size  int
+}
+
+func (e *DataTooLargeError) Error() string {
+	return fmt.Sprintf("data of %s is %d bytes, exceeding limit of %d bytes", e.Path, e.Size, e.Limit)
+}
+
+// GetLimited is Get, refusing with a *DataTooLargeError to read data longer than maxBytes. The data length is
+// checked by a stat before the data is requested. The client library reads the response in full either way, so
+// data which grew in between the two requests is still read, but is then also refused.
+func (zook *ZooKeeper) GetLimited(path string, maxBytes int) ([]byte, error) {
 	connection, err := zook.connect()
 	if err != nil {
 		return []byte{}, err
 	}
 	defer connection.Close()
 
+	exists, stat, err := connection.Exists(path)
+	if err != nil {
+		return []byte{}, wrapError(path, err)
+	}
+	if !exists {
+		return []byte{}, wrapError(path, zk.ErrNoNode)
+	}
+	if int(stat.DataLength) > maxBytes {
+		return []byte{}, &DataTooLargeError{Path: path, Limit: maxBytes, Size: int(stat.DataLength)}
+	}
 	data, _, err := connection.Get(path)
-	return data, err
+	if err != nil {
+		return []byte{}, wrapError(path, err)
+	}
+	if len(data) > maxBytes {
+		return []byte{}, &DataTooLargeError{Path: path, Limit: maxBytes, Size: len(data)}
+	}
+	return data, nil
+}
+
+// gzipMagic is the header every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipIfCompressed decompresses given data if it is gzip compressed, returning the data as is otherwise
+func gunzipIfCompressed(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, false, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return data, false, err
+	}
+	defer reader.Close()
+	plain, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return data, false, err
+	}
+	return plain, true, nil
+}
+
+// GetAuto returns value associated with given path, transparently decompressing gzip compressed data.
+// It also returns whether decompression took place. Data which is not gzip compressed is returned as is.
+func (zook *ZooKeeper) GetAuto(path string) ([]byte, bool, error) {
+	data, err := zook.Get(path)
+	if err != nil {
+		return data, false, err
+	}
+	return gunzipIfCompressed(data)
+}
+
+// GetLines returns the lines of the value associated with given path which match given regular expression.
+// A plain substring is a valid such expression.
+func (zook *ZooKeeper) GetLines(path string, match string) ([]string, error) {
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return nil, err
+	}
+	data, err := zook.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if re.MatchString(line) {
+			result = append(result, line)
+		}
+	}
+	return result, nil
 }
 
 func (zook *ZooKeeper) GetACL(path string) (data []string, err error) {
@@ -126,50 +651,142 @@ func (zook *ZooKeeper) GetACL(path string) (data []string, err error) {
 	defer connection.Close()
 
 	perms, _, err := connection.GetACL(path)
-	return zook.aclsToString(perms), err
+	return zook.aclsToString(perms), wrapError(path, err)
 }
 
+// aclIDEscaper escapes commas in ACL ids, as found in x509 DNs, so that entries can be joined by commas and parsed
+// back with parseACLString
+var aclIDEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+
+// aclsToString formats given ACL entries as scheme:id:perms, escaping commas and backslashes in ids
 func (zook *ZooKeeper) aclsToString(acls []zk.ACL) (result []string) {
 	for _, acl := range acls {
-		var buffer bytes.Buffer
+		result = append(result, fmt.Sprintf("%v:%v:%s", acl.Scheme, aclIDEscaper.Replace(acl.ID), permsToString(acl.Perms)))
+	}
+	return result
+}
 
-		buffer.WriteString(fmt.Sprintf("%v:%v:", acl.Scheme, acl.ID))
+// permsToString formats given permissions as letters, in the order c, d, r, w, a
+func permsToString(perms int32) string {
+	var buffer bytes.Buffer
+	if perms&zk.PermCreate != 0 {
+		buffer.WriteString("c")
+	}
+	if perms&zk.PermDelete != 0 {
+		buffer.WriteString("d")
+	}
+	if perms&zk.PermRead != 0 {
+		buffer.WriteString("r")
+	}
+	if perms&zk.PermWrite != 0 {
+		buffer.WriteString("w")
+	}
+	if perms&zk.PermAdmin != 0 {
+		buffer.WriteString("a")
+	}
+	return buffer.String()
+}
 
-		if acl.Perms&zk.PermCreate != 0 {
-			buffer.WriteString("c")
-		}
-		if acl.Perms&zk.PermDelete != 0 {
-			buffer.WriteString("d")
-		}
-		if acl.Perms&zk.PermRead != 0 {
-			buffer.WriteString("r")
-		}
-		if acl.Perms&zk.PermWrite != 0 {
-			buffer.WriteString("w")
+// Children returns sub-paths of given path, optionally empty array, or error if path does not exist
+func (zook *ZooKeeper) Children(path string) ([]string, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return []string{}, err
+	}
+	defer client.Close()
+
+	return client.Children(path)
+}
+
+// ChildrenCount returns the number of children of given path, as read from its metadata, without listing them,
+// which for very wide nodes saves transferring all their names. The count is the server's at the time of reading,
+// and may be stale by the time it is used.
+func (zook *ZooKeeper) ChildrenCount(path string) (int32, error) {
+	stat, err := zook.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.NumChildren, nil
+}
+
+// ChildInfo is a child's name along with its metadata
+type ChildInfo struct {
+	Name string
+	Stat *zk.Stat
+}
+
+// childrenInfoInternal: lists children of given path along with their metadata. Children which vanish
+// while being read are omitted.
+func (zook *ZooKeeper) childrenInfoInternal(connection *zk.Conn, path string) ([]ChildInfo, error) {
+	children, _, err := connection.Children(path)
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(children))
+	stats := make([]*zk.Stat, len(children))
+	errs := make([]error, len(children))
+	forEachConcurrently(len(children), func(i int) {
+		zook.throttle(1)
+		exists[i], stats[i], errs[i] = connection.Exists(gopath.Join(path, children[i]))
+	})
+	result := []ChildInfo{}
+	for i, child := range children {
+		if errs[i] != nil {
+			return result, errs[i]
 		}
-		if acl.Perms&zk.PermAdmin != 0 {
-			buffer.WriteString("a")
+		if exists[i] {
+			result = append(result, ChildInfo{Name: child, Stat: stats[i]})
 		}
-		result = append(result, buffer.String())
 	}
-	return result
+	return result, nil
 }
 
-// Children returns sub-paths of given path, optionally empty array, or error if path does not exist
-func (zook *ZooKeeper) Children(path string) ([]string, error) {
+// ChildrenWithStat returns the children of given path along with their metadata, sorted by name. The metadata
+// takes a request per child on top of the listing; these are issued concurrently, over a single connection.
+// Children deleted in between are omitted.
+func (zook *ZooKeeper) ChildrenWithStat(path string) ([]ChildInfo, error) {
 	connection, err := zook.connect()
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
 	defer connection.Close()
 
-	children, _, err := connection.Children(path)
-	return children, err
+	zook.throttle(1)
+	result, err := zook.childrenInfoInternal(connection, path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// ChildrenByCreation returns the children of given path along with their metadata, ordered by creation (czxid).
+// This is the true creation order, regardless of children names.
+func (zook *ZooKeeper) ChildrenByCreation(path string) ([]ChildInfo, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	result, err := zook.childrenInfoInternal(connection, path)
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Stat.Czxid < result[j].Stat.Czxid })
+	return result, wrapError(path, err)
 }
 
 // childrenRecursiveInternal: internal implementation of recursive-children query.
 func (zook *ZooKeeper) childrenRecursiveInternal(connection *zk.Conn, path string, incrementalPath string) ([]string, error) {
+	return zook.childrenRecursiveTimed(connection, path, incrementalPath, nil)
+}
+
+// childrenRecursiveTimed: childrenRecursiveInternal, reporting the latency of each Children call to onCall, if given
+func (zook *ZooKeeper) childrenRecursiveTimed(connection *zk.Conn, path string, incrementalPath string, onCall func(latency time.Duration)) ([]string, error) {
+	zook.throttle(1)
+	start := time.Now()
 	children, _, err := connection.Children(path)
+	if onCall != nil {
+		onCall(time.Since(start))
+	}
 	if err != nil {
 		return children, err
 	}
@@ -179,7 +796,7 @@ func (zook *ZooKeeper) childrenRecursiveInternal(connection *zk.Conn, path strin
 		incrementalChild := gopath.Join(incrementalPath, child)
 		recursiveChildren = append(recursiveChildren, incrementalChild)
 		log.Debugf("incremental child: %+v", incrementalChild)
-		incrementalChildren, err := zook.childrenRecursiveInternal(connection, gopath.Join(path, child), incrementalChild)
+		incrementalChildren, err := zook.childrenRecursiveTimed(connection, gopath.Join(path, child), incrementalChild, onCall)
 		if err != nil {
 			return children, err
 		}
@@ -190,7 +807,8 @@ func (zook *ZooKeeper) childrenRecursiveInternal(connection *zk.Conn, path strin
 
 // ChildrenRecursive returns list of all descendants of given path (optionally empty), or error if the path
 // does not exist.
-// Every element in result list is a relative subpath for the given path.
+// Every element in result list is a relative subpath for the given path. Given "/", it lists the entire tree,
+// including ZooKeeper's own /zookeeper.
 func (zook *ZooKeeper) ChildrenRecursive(path string) ([]string, error) {
 	connection, err := zook.connect()
 	if err != nil {
@@ -199,60 +817,185 @@ func (zook *ZooKeeper) ChildrenRecursive(path string) ([]string, error) {
 	defer connection.Close()
 
 	result, err := zook.childrenRecursiveInternal(connection, path, "")
-	return result, err
+	return result, wrapError(path, err)
 }
 
-// createInternal: create a new path
-func (zook *ZooKeeper) createInternal(connection *zk.Conn, path string, data []byte, acl []zk.ACL, force bool) (string, error) {
-	if path == "/" {
-		return "/", nil
+// ChildrenRecursiveParallel is ChildrenRecursive, listing up to workers nodes at a time, concurrently, over a
+// single connection, which on large trees saves most of the round trips' latency. The tree is listed a level at
+// a time; the result is then sorted into ChildrenRecursive's order. Should any listing fail, the first failure
+// is returned.
+func (zook *ZooKeeper) ChildrenRecursiveParallel(path string, workers int) ([]string, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("workers must be positive, got %d", workers)
 	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
 
-	log.Debugf("creating: %s", path)
-	attempts := 0
-	for {
-		attempts += 1
-		returnValue, err := connection.Create(path, data, zook.flags, zook.acl)
-		log.Debugf("create status for %s: %s, %+v", path, returnValue, err)
-
-		if err != nil && force && attempts < 2 {
-			parentPath := gopath.Dir(path)
-			if parentPath == path {
-				return returnValue, err
+	zook.throttle(1)
+	if exists, _, err := connection.Exists(path); err != nil {
+		return nil, wrapError(path, err)
+	} else if !exists {
+		return nil, wrapError(path, zk.ErrNoNode)
+	}
+	result := []string{}
+	level := []string{""}
+	for len(level) > 0 {
+		children := make([][]string, len(level))
+		errs := make([]error, len(level))
+		forEachWithConcurrency(len(level), workers, func(i int) {
+			zook.throttle(1)
+			children[i], _, errs[i] = connection.Children(gopath.Join(path, level[i]))
+		})
+		nextLevel := []string{}
+		for i, relativePath := range level {
+			if errs[i] != nil {
+				return nil, wrapError(gopath.Join(path, relativePath), errs[i])
+			}
+			for _, child := range children[i] {
+				nextLevel = append(nextLevel, gopath.Join(relativePath, child))
 			}
-			returnValue, err = zook.createInternal(connection, parentPath, []byte("zookeepercli auto-generated"), acl, force)
-		} else {
-			return returnValue, err
 		}
+		result = append(result, nextLevel...)
+		level = nextLevel
 	}
-	return "", nil
+	sort.Slice(result, func(i, j int) bool { return preOrderLess(result[i], result[j]) })
+	return result, nil
 }
 
-// createInternalWithACL: create a new path with acl
-func (zook *ZooKeeper) createInternalWithACL(connection *zk.Conn, path string, data []byte, force bool, perms []zk.ACL) (string, error) {
+// preOrderLess orders relative paths as a depth first walk visiting children by name lists them: by name,
+// component by component, with each path preceding its descendants
+func preOrderLess(a string, b string) bool {
+	aComponents, bComponents := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(aComponents) && i < len(bComponents); i++ {
+		if aComponents[i] != bComponents[i] {
+			return aComponents[i] < bComponents[i]
+		}
+	}
+	return len(aComponents) < len(bComponents)
+}
+
+// countDescendantsInternal: internal implementation of recursive descendants count
+func (zook *ZooKeeper) countDescendantsInternal(connection *zk.Conn, path string) (int, error) {
+	zook.throttle(1)
+	children, _, err := connection.Children(path)
+	if err != nil {
+		return 0, err
+	}
+	count := len(children)
+	for _, child := range children {
+		childCount, err := zook.countDescendantsInternal(connection, gopath.Join(path, child))
+		if err != nil {
+			return count, err
+		}
+		count += childCount
+	}
+	return count, nil
+}
+
+// AllChildrenCount returns the number of all descendants of given path, or error if the path does not exist.
+// ZooKeeper 3.6 offers a server side getAllChildrenNumber for this; the go-zookeeper client we build with
+// does not support that request, hence the count is always computed by walking the tree client side.
+// This is still cheaper than ChildrenRecursive as no paths are accumulated.
+func (zook *ZooKeeper) AllChildrenCount(path string) (int, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	count, err := zook.countDescendantsInternal(connection, path)
+	return count, wrapError(path, err)
+}
+
+// createInternal: create a new path with given acl. With force, should its parent be missing, creates all its
+// missing ancestors, however deep, with parentData and the same acl, or that of their nearest existing ancestor
+// (see SetInheritParentACL), then retries the path once.
+func (zook *ZooKeeper) createInternal(connection *zk.Conn, path string, data []byte, acl []zk.ACL, force bool, parentData []byte) (string, error) {
+	return zook.createInternalWithFlags(connection, path, data, zook.flags, acl, force, parentData)
+}
+
+// createInternalWithFlags: createInternal, creating the path with given flags rather than the default ones
+func (zook *ZooKeeper) createInternalWithFlags(connection *zk.Conn, path string, data []byte, flags int32, acl []zk.ACL, force bool, parentData []byte) (string, error) {
 	if path == "/" {
 		return "/", nil
 	}
-	log.Debugf("creating: %s with acl ", path)
-	attempts := 0
-	for {
-		attempts += 1
-		returnValue, err := connection.Create(path, data, zook.flags, perms)
-		log.Debugf("create status for %s: %s, %+v", path, returnValue, err)
-		if err != nil && force && attempts < 2 {
-			returnValue, err = zook.createInternalWithACL(connection, gopath.Dir(path), []byte("zookeepercli auto-generated"), force, perms)
-		} else {
-			return returnValue, err
+
+	log.Debugf("creating: %s", path)
+	returnValue, err := zook.createNode(connection, path, data, flags, acl)
+	log.Debugf("create status for %s: %s, %+v", path, returnValue, err)
+	if err != zk.ErrNoNode || !force {
+		return returnValue, err
+	}
+	parentACL := acl
+	if zook.inheritParentACL {
+		if parentACL, err = zook.nearestAncestorACLInternal(connection, path); err != nil {
+			return "", err
 		}
 	}
-	return "", nil
+	if err := zook.createParentsInternal(connection, gopath.Dir(path), parentACL, parentData); err != nil {
+		return "", err
+	}
+	return zook.createNode(connection, path, data, flags, acl)
+}
+
+// nearestAncestorACLInternal returns the ACL of the deepest existing ancestor of given path
+func (zook *ZooKeeper) nearestAncestorACLInternal(connection *zk.Conn, path string) ([]zk.ACL, error) {
+	for ancestor := gopath.Dir(path); ; ancestor = gopath.Dir(ancestor) {
+		zook.throttle(1)
+		acl, _, err := connection.GetACL(ancestor)
+		if err != zk.ErrNoNode || ancestor == "/" {
+			return acl, err
+		}
+	}
+}
+
+// createInternalWithACL: createInternal, with arguments ordered as CreateWithACL's
+func (zook *ZooKeeper) createInternalWithACL(connection *zk.Conn, path string, data []byte, force bool, perms []zk.ACL, parentData []byte) (string, error) {
+	return zook.createInternal(connection, path, data, perms, force, parentData)
+}
+
+// CreateOptions control the behavior of CreateWithOptions
+type CreateOptions struct {
+	// Force recursively creates missing parent directories
+	Force bool
+	// ParentData is the data of parent directories created by Force. Defaults to the auto-generated marker
+	// (see SetAutoParentData)
+	ParentData []byte
+	// Strategy determines what happens when the path already exists. Defaults to CreateFail
+	Strategy CreateStrategy
+	// Merge computes the data to set on an existing path from its current data and the data given to create.
+	// Required by, and only used with, CreateMerge. The format of the data, and hence the merge, is up to the
+	// application.
+	Merge func(existing []byte, data []byte) ([]byte, error)
 }
 
+// CreateStrategy determines how CreateWithOptions handles a path which already exists
+type CreateStrategy int
+
+const (
+	// CreateFail returns an error of kind ErrNodeExists
+	CreateFail CreateStrategy = iota
+	// CreateSkip leaves the existing node as is, and returns successfully
+	CreateSkip
+	// CreateOverwrite sets the given data on the existing node
+	CreateOverwrite
+	// CreateMerge sets the result of CreateOptions.Merge on the existing node, retrying as Update does
+	CreateMerge
+)
+
 // Create will create a new path, or exit with error should the path exist.
 // The "force" param controls the behavior when path's parent directory does not exist.
 // When "force" is false, the function returns with error/ When "force" is true, it recursively
 // attempts to create required parent directories.
 func (zook *ZooKeeper) Create(path string, data []byte, aclstr string, force bool) (string, error) {
+	return zook.CreateWithOptions(path, data, aclstr, CreateOptions{Force: force})
+}
+
+// CreateWithOptions is Create, with further control over the creation via given options.
+func (zook *ZooKeeper) CreateWithOptions(path string, data []byte, aclstr string, options CreateOptions) (string, error) {
 	connection, err := zook.connect()
 	if err != nil {
 		return "", err
@@ -265,8 +1008,117 @@ func (zook *ZooKeeper) Create(path string, data []byte, aclstr string, force boo
 			return "", err
 		}
 	}
+	if options.Strategy == CreateMerge && options.Merge == nil {
+		return "", errors.New("merge create strategy requires a merge function")
+	}
+	parentData := options.ParentData
+	if parentData == nil {
+		parentData = zook.autoParentData
+	}
+
+	result, err := zook.createInternal(connection, path, data, zook.acl, options.Force, parentData)
+	if err != zk.ErrNodeExists {
+		return result, wrapError(path, err)
+	}
+	switch options.Strategy {
+	case CreateSkip:
+		log.Debugf("%s exists, skipping", path)
+		return path, nil
+	case CreateOverwrite:
+		if _, err := zook.setNode(connection, path, data, -1); err != nil {
+			return "", wrapError(path, err)
+		}
+		return path, nil
+	case CreateMerge:
+		mutate := func(existing []byte) ([]byte, error) {
+			return options.Merge(existing, data)
+		}
+		if _, err := zook.updateInternal(connection, path, mutate); err != nil {
+			return "", wrapError(path, err)
+		}
+		return path, nil
+	}
+	return result, wrapError(path, err)
+}
+
+// Upsert creates given path with given data, or, should it exist, sets its data, over a single connection,
+// without the race of checking for existence first. aclstr, which defaults to the default ACL when empty, and
+// force apply as to Create, and only upon creation. Returns the node's metadata, which for a created node is read
+// right after creating it.
+func (zook *ZooKeeper) Upsert(path string, data []byte, aclstr string, force bool) (*zk.Stat, error) {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return nil, err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
 
-	return zook.createInternal(connection, path, data, zook.acl, force)
+	_, err = zook.createInternal(connection, path, data, acl, force, zook.autoParentData)
+	if err == nil {
+		zook.throttle(1)
+		_, stat, err := connection.Exists(path)
+		return stat, wrapError(path, err)
+	}
+	if err != zk.ErrNodeExists {
+		return nil, wrapError(path, err)
+	}
+	stat, err := zook.setNode(connection, path, data, -1)
+	return stat, wrapError(path, err)
+}
+
+// CreateAndStat creates given path with given data and flags (e.g. zk.FlagSequence), then reads the metadata of
+// the created node over the same connection. Returns the created path, which for a sequential node is the name
+// the server assigned, along with its metadata. aclstr and force apply as to Create.
+func (zook *ZooKeeper) CreateAndStat(path string, data []byte, aclstr string, force bool, flags int32) (string, *zk.Stat, error) {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return "", nil, err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return "", nil, err
+	}
+	defer connection.Close()
+
+	created, err := zook.createInternalWithFlags(connection, path, data, flags, acl, force, zook.autoParentData)
+	if err != nil {
+		return "", nil, wrapError(path, err)
+	}
+	zook.throttle(1)
+	_, stat, err := connection.Exists(created)
+	return created, stat, wrapError(created, err)
+}
+
+// CreateIfNotExists is Create, succeeding, rather than failing, should the path exist, in which case it is left
+// as is. Returns whether the path was created.
+func (zook *ZooKeeper) CreateIfNotExists(path string, data []byte, aclstr string, force bool) (bool, error) {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return false, err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	_, err = zook.createInternal(connection, path, data, acl, force, zook.autoParentData)
+	if err == zk.ErrNodeExists {
+		return false, nil
+	}
+	return err == nil, wrapError(path, err)
 }
 
 func (zook *ZooKeeper) CreateWithACL(path string, data []byte, force bool, perms []zk.ACL) (string, error) {
@@ -276,69 +1128,384 @@ func (zook *ZooKeeper) CreateWithACL(path string, data []byte, force bool, perms
 	}
 	defer connection.Close()
 
-	return zook.createInternalWithACL(connection, path, data, force, perms)
+	result, err := zook.createInternalWithACL(connection, path, data, force, perms, zook.autoParentData)
+	return result, wrapError(path, err)
+}
+
+// CreateWithParentACL creates given path with given data, ACL and flags (e.g. zk.FlagEphemeral), along with its
+// missing parent directories, which get parentACL instead, e.g. to keep ancestors navigable while locking down
+// the leaf. Parents are persistent, and get the auto-generated marker as data. It returns the created path.
+func (zook *ZooKeeper) CreateWithParentACL(path string, data []byte, leafACL []zk.ACL, parentACL []zk.ACL, flags int32) (string, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+
+	result, err := zook.createNode(connection, path, data, flags, leafACL)
+	if err != zk.ErrNoNode {
+		return result, wrapError(path, err)
+	}
+	if err := zook.createParentsInternal(connection, gopath.Dir(path), parentACL, zook.autoParentData); err != nil {
+		return "", wrapError(path, err)
+	}
+	result, err = zook.createNode(connection, path, data, flags, leafACL)
+	return result, wrapError(path, err)
+}
+
+// createParentsInternal creates given path and its missing ancestors, top down, as persistent nodes with given
+// ACL and data. Directories created concurrently by others are left as they are.
+func (zook *ZooKeeper) createParentsInternal(connection *zk.Conn, path string, acl []zk.ACL, data []byte) error {
+	if path == "/" {
+		return nil
+	}
+	_, err := zook.createNode(connection, path, data, 0, acl)
+	if err == zk.ErrNoNode {
+		if err := zook.createParentsInternal(connection, gopath.Dir(path), acl, data); err != nil {
+			return err
+		}
+		_, err = zook.createNode(connection, path, data, 0, acl)
+	}
+	if err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	return nil
+}
+
+// CreateSequential creates a new path named path followed by a server assigned, zero padded sequence number,
+// and returns the created path. There is no ZooKeeper counterpart for ephemeral nodes, as the throwaway
+// connection would take the node along when closed; see Client.CreateEphemeral.
+func (zook *ZooKeeper) CreateSequential(path string, data []byte, aclstr string) (string, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return client.CreateSequential(path, data, aclstr)
+}
+
+// CreateSequentialBatch creates a sequential node under parent per given value, named prefix followed by the
+// server assigned sequence number, and returns the created paths in creation order. All nodes are created over
+// a single connection. Should a creation fail, the paths created thus far are returned along with the error.
+func (zook *ZooKeeper) CreateSequentialBatch(parent string, prefix string, values [][]byte, aclstr string) ([]string, error) {
+	acl := zook.acl
+	if len(aclstr) > 0 {
+		var err error
+		if acl, err = zook.parseACLString(aclstr); err != nil {
+			return nil, err
+		}
+	}
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	// not gopath.Join, which would drop the trailing slash of an empty prefix
+	nodePath := strings.TrimSuffix(parent, "/") + "/" + prefix
+	result := []string{}
+	for _, data := range values {
+		created, err := zook.createNode(connection, nodePath, data, zk.FlagSequence, acl)
+		if err != nil {
+			return result, wrapError(nodePath, err)
+		}
+		result = append(result, created)
+	}
+	return result, nil
 }
 
 // Set updates a value for a given path, or returns with error if the path does not exist
 func (zook *ZooKeeper) Set(path string, data []byte) (*zk.Stat, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.Set(path, data)
+}
+
+// SetWithVersion updates a value for a given path only if its version is given version, as read by Stat or
+// GetWithStat, returning an error of kind ErrBadVersion if the path was modified since. A version of -1 matches any version,
+// which is what Set does.
+func (zook *ZooKeeper) SetWithVersion(path string, data []byte, version int32) (*zk.Stat, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.SetWithVersion(path, data, version)
+}
+
+// CompareAndSet reads the current version of given path and sets its data conditionally on that version,
+// returning an error of kind ErrBadVersion should the path be modified in between. Callers which based data on an earlier
+// read should rather use SetWithVersion with the version of that read; see also Update.
+func (zook *ZooKeeper) CompareAndSet(path string, data []byte) (*zk.Stat, error) {
+	client, err := zook.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	stat, err := client.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return client.SetWithVersion(path, data, stat.Version)
+}
+
+// backupDirName is the child of a node under which SetWithBackup keeps copies of its previous values
+const backupDirName = ".bak"
+
+// SetWithBackup sets given path's data, first copying its current data to a new child of path/.bak, named by
+// the time of the change (e.g. /config/.bak/20141002-153011.123456789). The .bak node is created as needed.
+// Copy and set are a single transaction, which, like Update, is retried should the node be modified concurrently.
+// Backups are never removed, and accumulate with each edit; prune them with ArchiveOldChildren or by hand.
+func (zook *ZooKeeper) SetWithBackup(path string, data []byte) (*zk.Stat, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	acl, _, err := connection.GetACL(path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	backupDir := gopath.Join(path, backupDirName)
+	if _, err := zook.createNode(connection, backupDir, []byte{}, 0, acl); err != nil && err != zk.ErrNodeExists {
+		return nil, wrapError(backupDir, err)
+	}
+	for attempt := 1; ; attempt++ {
+		current, stat, err := connection.Get(path)
+		if err != nil {
+			return nil, wrapError(path, err)
+		}
+		backupPath := gopath.Join(backupDir, time.Now().UTC().Format("20060102-150405.000000000"))
+		responses, err := zook.multi(connection,
+			&zk.CreateRequest{Path: backupPath, Data: current, Acl: acl, Flags: 0},
+			&zk.SetDataRequest{Path: path, Data: data, Version: stat.Version},
+		)
+		if err == nil {
+			log.Infof("Backed up %s to %s", path, backupPath)
+			return responses[1].Stat, nil
+		}
+		conflict := err == zk.ErrBadVersion || (len(responses) > 1 && responses[1].Error == zk.ErrBadVersion)
+		if !conflict || attempt >= zook.updateAttempts {
+			return nil, wrapError(path, err)
+		}
+		log.Debugf("Concurrent modification of %s, retrying set with backup", path)
+	}
+}
+
+// CompareAndAdvance sets given path's data to "to" only if its current data equals "from", returning whether
+// the transition took place. The write is conditional on the version at which "from" was read, so a concurrent
+// transition makes it return false rather than overwrite.
+func (zook *ZooKeeper) CompareAndAdvance(path string, from []byte, to []byte) (bool, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+
+	current, stat, err := connection.Get(path)
+	if err != nil {
+		return false, wrapError(path, err)
+	}
+	if !bytes.Equal(current, from) {
+		return false, nil
+	}
+	_, err = zook.setNode(connection, path, to, stat.Version)
+	if err == zk.ErrBadVersion {
+		return false, nil
+	}
+	return err == nil, wrapError(path, err)
+}
+
+// Update reads given path's data, applies mutate to it, and writes the result conditionally on the version read.
+// Should the node be modified concurrently, the entire cycle is retried, up to the configured number of attempts
+// (see SetUpdateAttempts), after which an error of kind ErrBadVersion is returned. An error returned by mutate aborts the update
+// immediately, without retrying.
+func (zook *ZooKeeper) Update(path string, mutate func(current []byte) ([]byte, error)) (*zk.Stat, error) {
 	connection, err := zook.connect()
 	if err != nil {
 		return nil, err
 	}
 	defer connection.Close()
 
-	return connection.Set(path, data, -1)
+	stat, err := zook.updateInternal(connection, path, mutate)
+	return stat, wrapError(path, err)
+}
+
+// updateInternal: internal implementation of Update, over given connection
+func (zook *ZooKeeper) updateInternal(connection *zk.Conn, path string, mutate func(current []byte) ([]byte, error)) (*zk.Stat, error) {
+	for attempt := 1; ; attempt++ {
+		current, stat, err := connection.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := mutate(current)
+		if err != nil {
+			return nil, err
+		}
+		stat, err = zook.setNode(connection, path, data, stat.Version)
+		if err != zk.ErrBadVersion || attempt >= zook.updateAttempts {
+			return stat, err
+		}
+		log.Debugf("Concurrent modification of %s, retrying update", path)
+	}
+}
+
+// BumpVersion increments the integer stored as decimal text at given path, and returns the new value. A missing
+// path is created holding the initial version (see SetInitialVersion). Consumers may watch the path as a config
+// generation counter. Increments are versioned writes, retried upon concurrent bumps as Update does.
+func (zook *ZooKeeper) BumpVersion(path string) (int64, error) {
+	connection, err := zook.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer connection.Close()
+
+	for attempt := 1; ; attempt++ {
+		data, stat, err := connection.Get(path)
+		if err == zk.ErrNoNode {
+			initial := zook.initialVersion
+			_, err = zook.createNode(connection, path, []byte(strconv.FormatInt(initial, 10)), 0, zook.acl)
+			if err == nil {
+				return initial, nil
+			}
+			if err != zk.ErrNodeExists || attempt >= zook.updateAttempts {
+				return 0, wrapError(path, err)
+			}
+			continue
+		}
+		if err != nil {
+			return 0, wrapError(path, err)
+		}
+		current, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("data of %s is not an integer: %q", path, data)
+		}
+		next := current + 1
+		_, err = zook.setNode(connection, path, []byte(strconv.FormatInt(next, 10)), stat.Version)
+		if err == nil {
+			return next, nil
+		}
+		if err != zk.ErrBadVersion || attempt >= zook.updateAttempts {
+			return 0, wrapError(path, err)
+		}
+		log.Debugf("Concurrent modification of %s, retrying version bump", path)
+	}
 }
 
 // updates the ACL on a given path
 func (zook *ZooKeeper) SetACL(path string, aclstr string, force bool) (string, error) {
+	if _, err := zook.SetACLWithDryRun(path, aclstr, force, false); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// SetACLWithDryRun is SetACL, returning the paths which were (or, with dryRun, would be) written: given path, and
+// with force, its missing ancestors, which are created top down along with it when it does not exist. With dryRun
+// nothing is written.
+func (zook *ZooKeeper) SetACLWithDryRun(path string, aclstr string, force bool, dryRun bool) ([]string, error) {
 	connection, err := zook.connect()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer connection.Close()
 
 	acl, err := zook.parseACLString(aclstr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if force {
-		exists, _, err := connection.Exists(path)
-		if err != nil {
-			return "", err
+	exists, _, err := connection.Exists(path)
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	if exists || !force {
+		if dryRun {
+			if !exists {
+				return nil, wrapError(path, zk.ErrNoNode)
+			}
+			return []string{path}, nil
 		}
+		_, err = zook.setNodeACL(connection, path, acl, -1)
+		return []string{path}, wrapError(path, err)
+	}
 
-		if !exists {
-			return zook.createInternal(connection, path, []byte(""), acl, force)
+	created := []string{path}
+	for parent := gopath.Dir(path); parent != "/"; parent = gopath.Dir(parent) {
+		exists, _, err := connection.Exists(parent)
+		if err != nil {
+			return nil, wrapError(parent, err)
 		}
+		if exists {
+			break
+		}
+		created = append([]string{parent}, created...)
 	}
-
-	_, err = connection.SetACL(path, acl, -1)
-	return path, err
+	if dryRun {
+		return created, nil
+	}
+	_, err = zook.createInternal(connection, path, []byte(""), acl, force, zook.autoParentData)
+	return created, wrapError(path, err)
 }
 
+// parseACLString parses ACL entries of the form scheme:id:perms, separated by commas or newlines, as GetACL
+// returns them one per entry, so that its output can be given back as is. Whitespace around entries is ignored. A
+// comma within an id, as in x509 DNs, is escaped with a backslash, as is a backslash itself.
 func (zook *ZooKeeper) parseACLString(aclstr string) (acl []zk.ACL, err error) {
-	aclsList := strings.Split(aclstr, ",")
-	for _, entry := range aclsList {
-		parts := strings.Split(entry, ":")
-		var scheme, id string
-		var perms int32
-		if len(parts) > 3 && parts[0] == "digest" {
-			scheme = parts[0]
-			id = fmt.Sprintf("%s:%s", parts[1], parts[2])
-			perms, err = zook.parsePermsString(parts[3])
-		} else {
-			scheme, id = parts[0], parts[1]
-			perms, err = zook.parsePermsString(parts[2])
+	for _, entry := range splitACLEntries(aclstr) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// The id may itself contain colons, e.g. digest user:password or x509 DNs, hence it is everything
+		// between the scheme and the trailing perms
+		schemeEnd, permsStart := strings.Index(entry, ":"), strings.LastIndex(entry, ":")
+		if schemeEnd <= 0 || permsStart == schemeEnd {
+			return nil, fmt.Errorf("invalid ACL entry %q, expected scheme:id:perms", entry)
+		}
+		scheme, id := entry[:schemeEnd], entry[schemeEnd+1:permsStart]
+		perms, err := zook.parsePermsString(entry[permsStart+1:])
+		if err != nil {
+			return nil, err
 		}
+		acl = append(acl, zk.ACL{Scheme: scheme, ID: id, Perms: perms})
+	}
+	if len(acl) == 0 {
+		return nil, errors.New("empty ACL string specified")
+	}
+	return acl, nil
+}
 
-		if err == nil {
-			perm := zk.ACL{Scheme: scheme, ID: id, Perms: perms}
-			acl = append(acl, perm)
+// splitACLEntries splits given ACL string on unescaped commas and newlines, unescaping the entries
+func splitACLEntries(aclstr string) (entries []string) {
+	var entry strings.Builder
+	escaped := false
+	for _, r := range aclstr {
+		switch {
+		case escaped:
+			entry.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',' || r == '\n':
+			entries = append(entries, entry.String())
+			entry.Reset()
+		default:
+			entry.WriteRune(r)
 		}
 	}
-	return acl, err
+	if escaped {
+		entry.WriteRune('\\')
+	}
+	return append(entries, entry.String())
 }
 
 func (zook *ZooKeeper) parsePermsString(permstr string) (perms int32, err error) {
@@ -376,28 +1543,57 @@ func (zook *ZooKeeper) parsePermsString(permstr string) (perms int32, err error)
 
 // Delete removes a path entry. It exits with error if the path does not exist, or has subdirectories.
 func (zook *ZooKeeper) Delete(path string) error {
-	connection, err := zook.connect()
+	client, err := zook.NewClient()
 	if err != nil {
 		return err
 	}
-	defer connection.Close()
+	defer client.Close()
 
-	return connection.Delete(path, -1)
+	return client.Delete(path)
 }
 
-// Delete recursive if has subdirectories.
+// DeleteRecursive deletes given path along with all its descendants, deepest first. It stops at, and returns,
+// the first failure; nodes deleted by then remain deleted. Nodes concurrently deleted by others are skipped.
 func (zook *ZooKeeper) DeleteRecursive(path string) error {
-	result, err := zook.ChildrenRecursive(path)
+	_, err := zook.DeleteRecursiveWithDryRun(path, false)
+	return err
+}
+
+// DeleteRecursiveWithDryRun is DeleteRecursive, returning the paths which were (or, with dryRun, would be)
+// deleted, in order of deletion. With dryRun nothing is deleted.
+func (zook *ZooKeeper) DeleteRecursiveWithDryRun(path string, dryRun bool) ([]string, error) {
+	if path == "/" {
+		return nil, errDeleteRoot
+	}
+	connection, err := zook.connect()
 	if err != nil {
-		log.Fatale(err)
+		return nil, err
 	}
+	defer connection.Close()
 
+	result, err := zook.childrenRecursiveInternal(connection, path, "")
+	if err != nil {
+		return nil, wrapError(path, err)
+	}
+	toDelete := []string{}
 	for i := len(result) - 1; i >= 0; i-- {
-		znode := path + "/" + result[i]
-		if err = zook.Delete(znode); err != nil {
-			log.Fatale(err)
-		}
+		toDelete = append(toDelete, gopath.Join(path, result[i]))
+	}
+	toDelete = append(toDelete, path)
+	if dryRun {
+		return toDelete, nil
 	}
 
-	return zook.Delete(path)
+	deleted := []string{}
+	for _, znode := range toDelete[:len(toDelete)-1] {
+		if err := zook.deleteNode(connection, znode, -1); err != nil && err != zk.ErrNoNode {
+			return deleted, fmt.Errorf("cannot delete %s: %w", znode, wrapError(znode, err))
+		} else if err == nil {
+			deleted = append(deleted, znode)
+		}
+	}
+	if err := zook.deleteNode(connection, path, -1); err != nil {
+		return deleted, wrapError(path, err)
+	}
+	return append(deleted, path), nil
 }
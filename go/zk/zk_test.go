@@ -18,10 +18,36 @@
 package zk
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"github.com/samuel/go-zookeeper/zk"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// startTestZooKeeper starts a single server ZooKeeper and returns a ZooKeeper connected to it, along with
+// a function stopping the server. The test is skipped when no ZooKeeper server is available
+// (see ZOOKEEPER_PATH in go-zookeeper's server_java.go).
+func startTestZooKeeper(t testing.TB) (*ZooKeeper, func()) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skipf("ZooKeeper test server unavailable: %+v", err)
+	}
+	zook := NewZooKeeper()
+	zook.SetServers([]string{fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port)})
+	return zook, func() { cluster.Stop() }
+}
+
 func TestParseACLString(t *testing.T) {
 	cases := []struct {
 		aclstr string
@@ -34,6 +60,12 @@ func TestParseACLString(t *testing.T) {
 		{"ip:10.2.1.15/32:cdrwa", []zk.ACL{{Scheme: "ip", ID: "10.2.1.15/32", Perms: 31}}},
 		{"digest:username:pwhash:cd", []zk.ACL{{Scheme: "digest", ID: "username:pwhash", Perms: 12}}},
 		{"auth::cdrwa", []zk.ACL{{Scheme: "auth", ID: "", Perms: 31}}},
+		{"world:anyone:r,auth::cdrwa", []zk.ACL{{Scheme: "world", ID: "anyone", Perms: 1}, {Scheme: "auth", ID: "", Perms: 31}}},
+		{"world:anyone:r\n digest:username:pwhash:cdrwa\n", []zk.ACL{{Scheme: "world", ID: "anyone", Perms: 1}, {Scheme: "digest", ID: "username:pwhash", Perms: 31}}},
+		{"world:anyone:", []zk.ACL{{Scheme: "world", ID: "anyone", Perms: 0}}},
+		{"ip:10.0.0.0/8:rw", []zk.ACL{{Scheme: "ip", ID: "10.0.0.0/8", Perms: 3}}},
+		{"ip:fe80::1/64:r", []zk.ACL{{Scheme: "ip", ID: "fe80::1/64", Perms: 1}}},
+		{"x509:CN=urn:example:admin:cdrwa", []zk.ACL{{Scheme: "x509", ID: "CN=urn:example:admin", Perms: 31}}},
 	}
 
 	for _, c := range cases {
@@ -61,6 +93,36 @@ func TestParseInvalidACLString(t *testing.T) {
 	}
 }
 
+func TestParseShortACLString(t *testing.T) {
+	zook := NewZooKeeper()
+	for _, aclstr := range []string{"", "world:anyone", "world:anyone:r,world", ":anyone:r", "digest:username:pwhash:cd:extra", "world:anyone:x,world:anyone:r"} {
+		if acl, err := zook.parseACLString(aclstr); err == nil {
+			t.Errorf("parseACLString(%q) == %v, want error", aclstr, acl)
+		}
+	}
+}
+
+func TestGetACLSetACL(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	aclstr := "world:anyone:r,digest:user:" + GenerateDigest("user", "password") + ":cdrwa"
+	if _, err := zook.Create("/roundtrip", []byte{}, aclstr, false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	before, err := zook.GetACL("/roundtrip")
+	if err != nil {
+		t.Fatalf("GetACL error %q", err)
+	}
+	if _, err := zook.SetACL("/roundtrip", strings.Join(before, "\n"), false); err != nil {
+		t.Fatalf("SetACL of GetACL output error %q", err)
+	}
+	after, err := zook.GetACL("/roundtrip")
+	if err != nil || strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("GetACL after SetACL == %q, %v, want %q", after, err, before)
+	}
+}
+
 func aclsEqual(a, b []zk.ACL) bool {
 	if len(a) != len(b) {
 		return false
@@ -73,3 +135,2519 @@ func aclsEqual(a, b []zk.ACL) bool {
 	}
 	return true
 }
+
+func TestLeaseData(t *testing.T) {
+	deadline := time.Unix(1413331200, 123*int64(time.Millisecond))
+	got, err := parseLeaseData(leaseData(deadline))
+	if err != nil {
+		t.Fatalf("parseLeaseData(leaseData(%v)) error %q", deadline, err)
+	}
+	if !got.Equal(deadline) {
+		t.Errorf("parseLeaseData(leaseData(%v)) == %v", deadline, got)
+	}
+	if _, err := parseLeaseData([]byte("not a lease")); err == nil {
+		t.Error("No error returned for invalid lease data")
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	zook := NewZooKeeper()
+	for _, ttl := range []time.Duration{-time.Second, 0, time.Nanosecond, MinLeaseTTL - 1} {
+		if _, err := zook.AcquireLease("/lease", ttl); err == nil {
+			t.Errorf("AcquireLease with ttl %v succeeded, want error", ttl)
+		}
+	}
+}
+
+func TestLease(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	ttl := 300 * time.Millisecond
+	lease, err := zook.AcquireLease("/lease", ttl)
+	if err != nil {
+		t.Fatalf("AcquireLease error %q", err)
+	}
+	if _, err := zook.AcquireLease("/lease", ttl); err == nil {
+		t.Errorf("AcquireLease of held lease succeeded, want error")
+	}
+
+	// renewal keeps pushing the expiry forward
+	time.Sleep(2 * ttl)
+	data, err := zook.Get("/lease")
+	if err != nil {
+		t.Fatalf("Get error %q", err)
+	}
+	if expiry, err := parseLeaseData(data); err != nil || !expiry.After(time.Now()) {
+		t.Errorf("lease expiry after renewal == %v, %v, want in the future", expiry, err)
+	}
+	select {
+	case <-lease.Lost():
+		t.Errorf("lease lost while renewed")
+	default:
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Errorf("Release error %q", err)
+	}
+	if err := lease.Release(); err != nil {
+		t.Errorf("second Release error %q", err)
+	}
+	if exists, err := zook.Exists("/lease"); err != nil || exists {
+		t.Errorf("Exists after Release == %v, %v, want false", exists, err)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/lease", leaseData(time.Now().Add(-time.Second)), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	lease, err := zook.AcquireLease("/lease", time.Second)
+	if err != nil {
+		t.Fatalf("AcquireLease of expired lease error %q", err)
+	}
+	defer lease.Release()
+	data, err := zook.Get("/lease")
+	if err != nil {
+		t.Fatalf("Get error %q", err)
+	}
+	if expiry, err := parseLeaseData(data); err != nil || !expiry.After(time.Now()) {
+		t.Errorf("lease expiry after takeover == %v, %v, want in the future", expiry, err)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	ttl := 300 * time.Millisecond
+	lease, err := zook.AcquireLease("/lease", ttl)
+	if err != nil {
+		t.Fatalf("AcquireLease error %q", err)
+	}
+	if _, err := zook.Set("/lease", []byte("taken")); err != nil {
+		t.Fatalf("Set error %q", err)
+	}
+	select {
+	case <-lease.Lost():
+	case <-time.After(3 * ttl):
+		t.Errorf("lease not lost after its node was modified by another")
+	}
+	if err := lease.Release(); err != nil {
+		t.Errorf("Release of lost lease error %q", err)
+	}
+	if data, err := zook.Get("/lease"); err != nil || string(data) != "taken" {
+		t.Errorf("Get after Release of lost lease == %q, %v, want %q", data, err, "taken")
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	count := 10 * maxConcurrency
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	visited := make([]bool, count)
+	forEachConcurrently(count, func(i int) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		visited[i] = true
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+	for i := range visited {
+		if !visited[i] {
+			t.Errorf("forEachConcurrently did not visit %d", i)
+		}
+	}
+	if maxRunning > maxConcurrency {
+		t.Errorf("forEachConcurrently ran %d concurrently, limit is %d", maxRunning, maxConcurrency)
+	}
+}
+
+func TestCreateWithOptionsParentData(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	options := CreateOptions{Force: true, ParentData: []byte("deploy-42")}
+	if _, err := zook.CreateWithOptions("/a/b/c", []byte("leaf"), "", options); err != nil {
+		t.Fatalf("CreateWithOptions error %q", err)
+	}
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/a", "deploy-42"},
+		{"/a/b", "deploy-42"},
+		{"/a/b/c", "leaf"},
+	}
+	for _, c := range cases {
+		got, err := zook.Get(c.path)
+		if err != nil {
+			t.Errorf("Get(%q) error %q", c.path, err)
+		} else if string(got) != c.want {
+			t.Errorf("Get(%q) == %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestCreateWithOptionsStrategy(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	concat := func(existing []byte, data []byte) ([]byte, error) {
+		return append(append(existing, ','), data...), nil
+	}
+	cases := []struct {
+		strategy CreateStrategy
+		merge    func(existing []byte, data []byte) ([]byte, error)
+		wantErr  error
+		want     string
+	}{
+		{CreateFail, nil, ErrNodeExists, "old"},
+		{CreateSkip, nil, nil, "old"},
+		{CreateOverwrite, nil, nil, "new"},
+		{CreateMerge, concat, nil, "old,new"},
+	}
+	for i, c := range cases {
+		path := fmt.Sprintf("/strategy-%d", i)
+		if _, err := zook.Create(path, []byte("old"), "", false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+		options := CreateOptions{Strategy: c.strategy, Merge: c.merge}
+		if _, err := zook.CreateWithOptions(path, []byte("new"), "", options); !isErrorKind(err, c.wantErr) {
+			t.Errorf("CreateWithOptions(%q) with strategy %d error %v, want %v", path, c.strategy, err, c.wantErr)
+		}
+		got, err := zook.Get(path)
+		if err != nil {
+			t.Errorf("Get(%q) error %q", path, err)
+		} else if string(got) != c.want {
+			t.Errorf("Get(%q) with strategy %d == %q, want %q", path, c.strategy, got, c.want)
+		}
+	}
+	if _, err := zook.CreateWithOptions("/strategy-0", []byte("new"), "", CreateOptions{Strategy: CreateMerge}); err == nil {
+		t.Errorf("CreateWithOptions with CreateMerge and no merge function succeeded, want error")
+	}
+}
+
+func TestACLStringRoundTrip(t *testing.T) {
+	acls := [][]zk.ACL{
+		zk.WorldACL(zk.PermAll),
+		zk.WorldACL(zk.PermRead | zk.PermWrite),
+		zk.DigestACL(zk.PermRead, "user", "password"),
+		{{Perms: zk.PermAll, Scheme: "ip", ID: "10.2.1.15/32"}, {Perms: zk.PermRead, Scheme: "world", ID: "anyone"}},
+		{{Perms: 0, Scheme: "world", ID: "anyone"}},
+		{{Perms: zk.PermAll, Scheme: "x509", ID: "CN=a,O=b"}, {Perms: zk.PermRead, Scheme: "x509", ID: `CN=c\,d,O=e`}},
+	}
+	zook := NewZooKeeper()
+	for _, acl := range acls {
+		for _, separator := range []string{",", "\n"} {
+			aclstr := strings.Join(zook.aclsToString(acl), separator)
+			parsed, err := zook.parseACLString(aclstr)
+			if err != nil {
+				t.Errorf("parseACLString(%q) error %q", aclstr, err)
+			} else if !ACLEqual(parsed, acl) {
+				t.Errorf("parseACLString(%q) == %v, want %v", aclstr, parsed, acl)
+			}
+		}
+	}
+}
+
+func TestParseACLStringEscapedComma(t *testing.T) {
+	zook := NewZooKeeper()
+	aclstr := `x509:CN=a\,O=b:cdrwa,world:anyone:r`
+	want := []zk.ACL{{Perms: zk.PermAll, Scheme: "x509", ID: "CN=a,O=b"}, {Perms: zk.PermRead, Scheme: "world", ID: "anyone"}}
+	if acl, err := zook.parseACLString(aclstr); err != nil {
+		t.Errorf("parseACLString(%q) error %q", aclstr, err)
+	} else if !ACLEqual(acl, want) {
+		t.Errorf("parseACLString(%q) == %v, want %v", aclstr, acl, want)
+	}
+	if got := strings.Join(zook.aclsToString(want), ","); got != aclstr {
+		t.Errorf("aclsToString(%v) == %q, want %q", want, got, aclstr)
+	}
+}
+
+func TestACLRecursiveRoundTrip(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	acls := map[string]string{
+		"/acls":       "world:anyone:cdrwa",
+		"/acls/a":     "world:anyone:cdrwa,digest:user:XDkd2dsEuhc9ImU3q8pa8UOdtpI=:r",
+		"/acls/a/b":   "ip:10.2.1.15/32:cdrwa,world:anyone:cdrwa",
+		"/acls/c":     "world:anyone:rwa",
+		"/acls/c/d/e": "ip:10.0.0.0/8:cdrw,world:anyone:cdrwa",
+	}
+	for _, path := range []string{"/acls", "/acls/a", "/acls/a/b", "/acls/c", "/acls/c/d", "/acls/c/d/e"} {
+		if _, err := zook.Create(path, []byte{}, "world:anyone:cdrwa", false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	for path, aclstr := range acls {
+		if _, err := zook.SetACL(path, aclstr, false); err != nil {
+			t.Fatalf("SetACL(%q) error %q", path, err)
+		}
+	}
+	snapshot, err := zook.GetACLRecursive("/acls")
+	if err != nil {
+		t.Fatalf("GetACLRecursive error %q", err)
+	}
+	if len(snapshot) != 6 {
+		t.Errorf("GetACLRecursive returned %d paths, want 6", len(snapshot))
+	}
+	for path := range snapshot {
+		if _, err := zook.SetACL(path, "world:anyone:cdrwa", false); err != nil {
+			t.Fatalf("SetACL(%q) error %q", path, err)
+		}
+	}
+	if err := zook.SetACLRecursiveFromMap(snapshot); err != nil {
+		t.Fatalf("SetACLRecursiveFromMap error %q", err)
+	}
+	restored, err := zook.GetACLRecursive("/acls")
+	if err != nil {
+		t.Fatalf("GetACLRecursive error %q", err)
+	}
+	for path, aclStrings := range snapshot {
+		want, _ := zook.parseACLString(strings.Join(aclStrings, ","))
+		got, _ := zook.parseACLString(strings.Join(restored[path], ","))
+		if !ACLEqual(got, want) {
+			t.Errorf("ACL of %q == %q after restore, want %q", path, restored[path], aclStrings)
+		}
+	}
+}
+
+func TestSequenceNumber(t *testing.T) {
+	cases := []struct {
+		name     string
+		sequence int64
+		ok       bool
+	}{
+		{"item-0000000042", 42, true},
+		{"0000000000", 0, true},
+		{"lock-2147483647", 2147483647, true},
+		{"item-42", 0, false},
+		{"config", 0, false},
+		{"item-00000000x2", 0, false},
+	}
+	for _, c := range cases {
+		sequence, ok := sequenceNumber(c.name)
+		if sequence != c.sequence || ok != c.ok {
+			t.Errorf("sequenceNumber(%q) == %d, %t, want %d, %t", c.name, sequence, ok, c.sequence, c.ok)
+		}
+	}
+}
+
+func TestSequenceCounter(t *testing.T) {
+	cases := []struct {
+		name    string
+		counter int32
+		ok      bool
+	}{
+		{"item-0000000042", 42, true},
+		{"item-2147483647", 2147483647, true},
+		{"item--2147483648", -2147483648, true},
+		{"item--000000001", -1, true},
+		{"item-42", 0, false},
+		{"other-0000000042", 0, false},
+		{"item-00000000x2", 0, false},
+	}
+	for _, c := range cases {
+		counter, ok := sequenceCounter(c.name, "item-")
+		if counter != c.counter || ok != c.ok {
+			t.Errorf("sequenceCounter(%q) == %d, %t, want %d, %t", c.name, counter, ok, c.counter, c.ok)
+		}
+	}
+}
+
+func TestSequenceGaps(t *testing.T) {
+	cases := []struct {
+		counters []int32
+		gaps     []int64
+	}{
+		{[]int32{}, []int64{}},
+		{[]int32{7}, []int64{}},
+		{[]int32{5, 1, 2, 7}, []int64{3, 4, 6}},
+		{[]int32{2147483646, -2147483647}, []int64{2147483647, -2147483648}},
+	}
+	for _, c := range cases {
+		gaps := sequenceGaps(c.counters)
+		if fmt.Sprint(gaps) != fmt.Sprint(c.gaps) {
+			t.Errorf("sequenceGaps(%v) == %v, want %v", c.counters, gaps, c.gaps)
+		}
+	}
+}
+
+func TestArchiveOldChildrenInvalidKeep(t *testing.T) {
+	zook := NewZooKeeper()
+	if archived, err := zook.ArchiveOldChildren("/queue", -1, "/archive"); err == nil || archived != 0 {
+		t.Errorf("ArchiveOldChildren with negative keepRecent == %d, %v, want error", archived, err)
+	}
+}
+
+func TestArchiveOldChildren(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/queue", []byte{}, "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := zook.CreateSequential("/queue/item-", []byte{}, ""); err != nil {
+			t.Fatalf("CreateSequential error %q", err)
+		}
+	}
+	archived, err := zook.ArchiveOldChildren("/queue", 2, "/archive/queue")
+	if err != nil || archived != 3 {
+		t.Errorf("ArchiveOldChildren == %d, %v, want 3", archived, err)
+	}
+	if children, err := zook.Children("/queue"); err != nil || len(children) != 2 {
+		t.Errorf("Children after ArchiveOldChildren == %q, %v, want 2 children", children, err)
+	}
+	if archived, err := zook.ArchiveOldChildren("/queue", 2, "/archive/queue"); err != nil || archived != 0 {
+		t.Errorf("ArchiveOldChildren with nothing to archive == %d, %v, want 0", archived, err)
+	}
+}
+
+func TestACLEqual(t *testing.T) {
+	world := zk.ACL{Scheme: "world", ID: "anyone", Perms: zk.PermRead}
+	digest := zk.ACL{Scheme: "digest", ID: "user:hash", Perms: zk.PermAll}
+	cases := []struct {
+		a, b []zk.ACL
+		want bool
+	}{
+		{[]zk.ACL{world, digest}, []zk.ACL{world, digest}, true},
+		{[]zk.ACL{world, digest}, []zk.ACL{digest, world}, true},
+		{[]zk.ACL{{Scheme: "world", ID: "anyone", Perms: zk.PermRead | zk.PermWrite}}, []zk.ACL{{Scheme: "world", ID: "anyone", Perms: zk.PermWrite | zk.PermRead}}, true},
+		{[]zk.ACL{{Scheme: "world", ID: "anyone", Perms: zk.PermRead}, {Scheme: "world", ID: "anyone", Perms: zk.PermWrite}}, []zk.ACL{{Scheme: "world", ID: "anyone", Perms: zk.PermRead | zk.PermWrite}}, true},
+		{nil, []zk.ACL{}, true},
+		{[]zk.ACL{world}, []zk.ACL{world, digest}, false},
+		{[]zk.ACL{world}, []zk.ACL{{Scheme: "world", ID: "anyone", Perms: zk.PermWrite}}, false},
+		{[]zk.ACL{world}, []zk.ACL{{Scheme: "ip", ID: "anyone", Perms: zk.PermRead}}, false},
+	}
+	for _, c := range cases {
+		if got := ACLEqual(c.a, c.b); got != c.want {
+			t.Errorf("ACLEqual(%v, %v) == %t, want %t", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{"value", `'value'`},
+		{"", `''`},
+		{"two words", `'two words'`},
+		{"it's", `'it'\''s'`},
+		{"$HOME `id`", "'$HOME `id`'"},
+	}
+	for _, c := range cases {
+		if got := shellQuote(c.s); got != c.want {
+			t.Errorf("shellQuote(%q) == %s, want %s", c.s, got, c.want)
+		}
+	}
+}
+
+func TestExportAsScriptACLOrder(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/script/a/b", []byte("b"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for _, path := range []string{"/script/a/b", "/script"} {
+		if _, err := zook.SetACL(path, "world:anyone:r", false); err != nil {
+			t.Fatalf("SetACL(%q) error %q", path, err)
+		}
+	}
+	var script bytes.Buffer
+	if err := zook.ExportAsScript("/script", &script); err != nil {
+		t.Fatalf("ExportAsScript error %q", err)
+	}
+	lastCreate, setACLs := -1, []string{}
+	for i, line := range strings.Split(script.String(), "\n") {
+		if strings.Contains(line, " -c creater ") {
+			lastCreate = i
+			if len(setACLs) > 0 {
+				t.Errorf("ExportAsScript creates after setting ACLs:\n%s", script.String())
+			}
+		}
+		if strings.Contains(line, " -c setacl ") {
+			setACLs = append(setACLs, strings.Fields(line)[5])
+		}
+	}
+	if lastCreate < 0 || strings.Join(setACLs, ",") != "'/script/a/b','/script'" {
+		t.Errorf("ExportAsScript set ACLs of %q, want deepest first:\n%s", setACLs, script.String())
+	}
+}
+
+func TestACLPolicyRuleMatches(t *testing.T) {
+	cases := []struct {
+		rule     ACLPolicyRule
+		path     string
+		want     bool
+		walkRoot string
+	}{
+		{ACLPolicyRule{Path: "/app"}, "/app", true, "/app"},
+		{ACLPolicyRule{Path: "/app"}, "/app/config", false, "/app"},
+		{ACLPolicyRule{Path: "/app", Recursive: true}, "/app/config/db", true, "/app"},
+		{ACLPolicyRule{Path: "/app/*/secrets"}, "/app/web/secrets", true, "/app"},
+		{ACLPolicyRule{Path: "/app/*/secrets"}, "/app/web/secrets/key", false, "/app"},
+		{ACLPolicyRule{Path: "/app/*/secrets", Recursive: true}, "/app/web/secrets/key", true, "/app"},
+		{ACLPolicyRule{Path: "/app/*/secrets", Recursive: true}, "/app/web/public", false, "/app"},
+		{ACLPolicyRule{Path: "/*", Recursive: true}, "/any/thing", true, "/"},
+		{ACLPolicyRule{Path: "/", Recursive: true}, "/any/thing", true, "/"},
+		{ACLPolicyRule{Path: "/", Recursive: true}, "/any", true, "/"},
+		{ACLPolicyRule{Path: "/", Recursive: true}, "/", true, "/"},
+		{ACLPolicyRule{Path: "/"}, "/any", false, "/"},
+	}
+	for _, c := range cases {
+		if got := c.rule.matches(c.path); got != c.want {
+			t.Errorf("%+v matches(%q) == %t, want %t", c.rule, c.path, got, c.want)
+		}
+		if got := c.rule.walkRoot(); got != c.walkRoot {
+			t.Errorf("%+v walkRoot() == %q, want %q", c.rule, got, c.walkRoot)
+		}
+	}
+}
+
+func TestExportBinaryDataRoundTrip(t *testing.T) {
+	export := &Export{Root: "/binary", Nodes: []ExportedNode{
+		{Path: "/binary", Data: []byte{}, ACL: []string{"world:anyone:cdrwa"}},
+		{Path: "/binary/nul", Data: []byte("a\x00b\x00"), ACL: []string{"world:anyone:cdrwa"}},
+		{Path: "/binary/invalid_utf8", Data: []byte{0xff, 0xfe, 0xc3, 0x28, 0xe2, 0x82}, ACL: []string{"world:anyone:cdrwa"}},
+		{Path: "/binary/all_bytes", Data: func() []byte {
+			data := make([]byte, 256)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			return data
+		}(), ACL: []string{"world:anyone:cdrwa"}},
+	}}
+	encoded, err := encodeExport(export)
+	if err != nil {
+		t.Fatalf("encodeExport error %q", err)
+	}
+	if bytes.Contains(encoded, []byte{0xff}) || bytes.Contains(encoded, []byte{0}) {
+		t.Errorf("encodeExport emitted raw binary data")
+	}
+	decoded, err := parseExport(encoded)
+	if err != nil {
+		t.Fatalf("parseExport error %q", err)
+	}
+	if len(decoded.Nodes) != len(export.Nodes) {
+		t.Fatalf("parseExport returned %d nodes, want %d", len(decoded.Nodes), len(export.Nodes))
+	}
+	for i, node := range export.Nodes {
+		if !bytes.Equal(decoded.Nodes[i].Data, node.Data) {
+			t.Errorf("data of %q == %q after round trip, want %q", node.Path, decoded.Nodes[i].Data, node.Data)
+		}
+	}
+}
+
+func TestDiffBackups(t *testing.T) {
+	jsonA := []byte(`{"root": "/app", "nodes": [
+		{"path": "/app", "data": "", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/same", "data": "YQ==", "acl": ["world:anyone:r", "ip:10.0.0.1:cdrwa"]},
+		{"path": "/app/data", "data": "YQ==", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/acl", "data": "YQ==", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/removed", "data": "YQ==", "acl": ["world:anyone:cdrwa"]}
+	]}`)
+	jsonB := []byte(`{"root": "/app", "nodes": [
+		{"path": "/app", "data": "", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/same", "data": "YQ==", "acl": ["ip:10.0.0.1:cdrwa", "world:anyone:r"]},
+		{"path": "/app/data", "data": "Yg==", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/acl", "data": "YQ==", "acl": ["world:anyone:r"]},
+		{"path": "/app/added", "data": "YQ==", "acl": ["world:anyone:cdrwa"]}
+	]}`)
+	want := []DiffEntry{
+		{Path: "/app/acl", Type: DiffChanged, Detail: "acl"},
+		{Path: "/app/added", Type: DiffAdded},
+		{Path: "/app/data", Type: DiffChanged, Detail: "data"},
+		{Path: "/app/removed", Type: DiffRemoved},
+	}
+
+	zook := NewZooKeeper()
+	got, err := zook.DiffBackups(jsonA, jsonB)
+	if err != nil {
+		t.Fatalf("DiffBackups error %q", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("DiffBackups == %v, want %v", got, want)
+	}
+	if _, err := zook.DiffBackups(jsonA, []byte("not json")); err == nil {
+		t.Error("No error returned for invalid document")
+	}
+}
+
+func TestGunzipIfCompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("some value"))
+	writer.Close()
+
+	cases := []struct {
+		data         []byte
+		want         string
+		decompressed bool
+	}{
+		{compressed.Bytes(), "some value", true},
+		{[]byte("some value"), "some value", false},
+		{[]byte{}, "", false},
+		{[]byte{0x1f}, "\x1f", false},
+	}
+	for _, c := range cases {
+		got, decompressed, err := gunzipIfCompressed(c.data)
+		if err != nil {
+			t.Errorf("gunzipIfCompressed(%q) error %q", c.data, err)
+		} else if string(got) != c.want || decompressed != c.decompressed {
+			t.Errorf("gunzipIfCompressed(%q) == %q, %t, want %q, %t", c.data, got, decompressed, c.want, c.decompressed)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(100)
+	start := time.Now()
+	// the first second's worth is available as a burst; the next 20 operations are paced at 10ms each
+	for i := 0; i < 120; i++ {
+		bucket.take(1)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("tokenBucket took %+v for 120 operations at 100/s with burst of 100, expected at least 200ms", elapsed)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("tokenBucket took %+v for 120 operations at 100/s with burst of 100, expected about 200ms", elapsed)
+	}
+}
+
+func TestACLGrants(t *testing.T) {
+	identities := []zk.ACL{{Scheme: "digest", ID: "user:hash"}, {Scheme: "ip", ID: "10.1.2.3"}}
+	tests := []struct {
+		acl      []zk.ACL
+		expected bool
+	}{
+		{[]zk.ACL{}, true},
+		{zk.WorldACL(zk.PermDelete), true},
+		{zk.WorldACL(zk.PermRead | zk.PermWrite), false},
+		{[]zk.ACL{{Perms: zk.PermAll, Scheme: "digest", ID: "user:hash"}}, true},
+		{[]zk.ACL{{Perms: zk.PermAll, Scheme: "digest", ID: "other:hash"}}, false},
+		{[]zk.ACL{{Perms: zk.PermDelete, Scheme: "ip", ID: "10.1.2.3"}}, true},
+		{[]zk.ACL{{Perms: zk.PermDelete, Scheme: "ip", ID: "10.1.0.0/16"}}, true},
+		{[]zk.ACL{{Perms: zk.PermDelete, Scheme: "ip", ID: "10.2.0.0/16"}}, false},
+		{[]zk.ACL{{Perms: zk.PermRead, Scheme: "ip", ID: "10.1.2.3"}, {Perms: zk.PermDelete, Scheme: "digest", ID: "user:hash"}}, true},
+	}
+	for _, test := range tests {
+		if granted := aclGrants(test.acl, identities, zk.PermDelete); granted != test.expected {
+			t.Errorf("aclGrants(%+v) = %t, expected %t", test.acl, granted, test.expected)
+		}
+	}
+}
+
+func TestWriteChildrenDelta(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeChildrenDelta(&buffer, []string{"a", "b", "c"}, []string{"c", "d", "a"}); err != nil {
+		t.Fatalf("writeChildrenDelta error %q", err)
+	}
+	if want := "+d\n-b\n"; buffer.String() != want {
+		t.Errorf("writeChildrenDelta wrote %q, want %q", buffer.String(), want)
+	}
+}
+
+func TestACLPermsFor(t *testing.T) {
+	identities := []zk.ACL{{Scheme: "digest", ID: "user:hash"}, {Scheme: "ip", ID: "10.1.2.3"}}
+	acl := []zk.ACL{
+		{Perms: zk.PermRead, Scheme: "world", ID: "anyone"},
+		{Perms: zk.PermWrite, Scheme: "digest", ID: "user:hash"},
+		{Perms: zk.PermCreate, Scheme: "ip", ID: "10.0.0.0/8"},
+		{Perms: zk.PermAdmin, Scheme: "digest", ID: "other:hash"},
+	}
+	if perms := permsToString(aclPermsFor(acl, identities)); perms != "crw" {
+		t.Errorf("aclPermsFor == %q, want %q", perms, "crw")
+	}
+}
+
+func TestNewWalkStats(t *testing.T) {
+	if stats := newWalkStats(nil); stats != (WalkStats{}) {
+		t.Errorf("newWalkStats(nil) == %+v, want zero", stats)
+	}
+	latencies := []time.Duration{}
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	want := WalkStats{
+		Calls: 100,
+		Total: 5050 * time.Millisecond,
+		Min:   time.Millisecond,
+		P50:   50 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}
+	if stats := newWalkStats(latencies); stats != want {
+		t.Errorf("newWalkStats == %+v, want %+v", stats, want)
+	}
+}
+
+func TestDumpNodeRoundTrip(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "zookeepercli-dump")
+	if err != nil {
+		t.Fatalf("TempDir error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte{0, 1, 0xff, 'x', 0}
+	if _, err := zook.Create("/dumped", data, "world:anyone:rwa", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if err := zook.DumpNode("/dumped", dir); err != nil {
+		t.Fatalf("DumpNode error %q", err)
+	}
+	if err := zook.UndumpNode("/restored/dumped", dir, "dumped", true); err != nil {
+		t.Fatalf("UndumpNode error %q", err)
+	}
+	got, err := zook.Get("/restored/dumped")
+	if err != nil {
+		t.Fatalf("Get error %q", err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("Get == %q after undump, want %q", got, data)
+	}
+	acl, err := zook.GetACL("/restored/dumped")
+	if err != nil {
+		t.Fatalf("GetACL error %q", err)
+	} else if !zook.aclStringsEqual(acl, []string{"world:anyone:rwa"}) {
+		t.Errorf("GetACL == %q after undump, want world:anyone:rwa", acl)
+	}
+	if err := zook.UndumpNode("/restored/missing", dir, "missing", true); err == nil {
+		t.Errorf("UndumpNode of missing dump succeeded, want error")
+	}
+}
+
+func TestParseServersFile(t *testing.T) {
+	content := []byte("# ensemble\nsrv-1:2181\n\n  srv-2   # second\n10.0.0.3:2182\n")
+	servers, chroot, err := parseServersFile(content)
+	if err != nil {
+		t.Fatalf("parseServersFile error %q", err)
+	}
+	if want := "srv-1:2181,srv-2,10.0.0.3:2182"; strings.Join(servers, ",") != want {
+		t.Errorf("parseServersFile == %q, want %q", servers, want)
+	}
+	if chroot != "" {
+		t.Errorf("parseServersFile chroot == %q, want none", chroot)
+	}
+	servers, chroot, err = parseServersFile([]byte("srv-1:2181/app\nsrv-2/app/\nsrv-3:2182\n"))
+	if err != nil {
+		t.Fatalf("parseServersFile with chroot error %q", err)
+	}
+	if want := "srv-1:2181,srv-2,srv-3:2182"; strings.Join(servers, ",") != want {
+		t.Errorf("parseServersFile with chroot == %q, want %q", servers, want)
+	}
+	if chroot != "/app" {
+		t.Errorf("parseServersFile chroot == %q, want /app", chroot)
+	}
+	for _, invalid := range []string{"", "# nothing\n", "srv-1:port\n", "srv-1:70000\n", ":2181\n", "srv 1\n", "/app\n", "srv-1/a\nsrv-2/b\n"} {
+		if servers, _, err := parseServersFile([]byte(invalid)); err == nil {
+			t.Errorf("parseServersFile(%q) == %q, want error", invalid, servers)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	client, err := NewClient(zook.getServers())
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer client.Close()
+
+	if _, err := zook.Create("/client/node", []byte("one"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if _, err := client.Set("/client/node", []byte("two")); err != nil {
+		t.Errorf("Set error %q", err)
+	}
+	if data, err := client.Get("/client/node"); err != nil || string(data) != "two" {
+		t.Errorf("Get == %q, %v, want %q", data, err, "two")
+	}
+	if children, err := client.Children("/client"); err != nil || len(children) != 1 || children[0] != "node" {
+		t.Errorf("Children == %q, %v, want [node]", children, err)
+	}
+	if err := client.Delete("/client/node"); err != nil {
+		t.Errorf("Delete error %q", err)
+	}
+	if exists, err := client.Exists("/client/node"); err != nil || exists {
+		t.Errorf("Exists after Delete == %t, %v, want false", exists, err)
+	}
+	if created, err := client.CreateSequential("/client/seq-", nil, ""); err != nil || len(created) != len("/client/seq-")+sequenceSuffixLength {
+		t.Errorf("CreateSequential == %q, %v, want /client/seq- with a sequence number", created, err)
+	}
+	if _, err := client.CreateEphemeral("/client/ephemeral", nil, ""); err != nil {
+		t.Errorf("CreateEphemeral error %q", err)
+	}
+	if stat, err := zook.Stat("/client/ephemeral"); err != nil || stat.EphemeralOwner == 0 {
+		t.Errorf("Stat of ephemeral == %+v, %v, want an ephemeral owner", stat, err)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	zook := NewZooKeeper()
+	for proxyURL, want := range map[string]string{"socks5://bastion": "bastion:1080", "http://bastion": "bastion:80", "socks5://u:p@bastion:9050": "bastion:9050"} {
+		if err := zook.SetProxy(proxyURL); err != nil {
+			t.Errorf("SetProxy(%q) error %q", proxyURL, err)
+		} else if zook.proxy.Host != want {
+			t.Errorf("SetProxy(%q) host == %q, want %q", proxyURL, zook.proxy.Host, want)
+		}
+	}
+	for _, invalid := range []string{"ftp://bastion", "bastion:1080", "socks5://", "://"} {
+		if err := zook.SetProxy(invalid); err == nil {
+			t.Errorf("SetProxy(%q) succeeded, want error", invalid)
+		}
+	}
+}
+
+func TestSocks5Connect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	requests := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(server, greeting)
+		server.Write([]byte{0x05, 0x00})
+		request := make([]byte, 5+len("srv-1")+2)
+		io.ReadFull(server, request)
+		requests <- request
+		server.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x08, 0x85})
+	}()
+	if err := socks5Connect(client, "srv-1:2181", nil); err != nil {
+		t.Fatalf("socks5Connect error %q", err)
+	}
+	want := append([]byte{0x05, 0x01, 0x00, 0x03, 5}, append([]byte("srv-1"), 0x08, 0x85)...)
+	if request := <-requests; !bytes.Equal(request, want) {
+		t.Errorf("socks5Connect request == %v, want %v", request, want)
+	}
+}
+
+func TestNegotiatedTimeout(t *testing.T) {
+	cons := " /127.0.0.1:54032[1](queued=0,recved=1,sent=1,sid=0x100012c5dc40000,lop=SESS,est=1485791245019,to=4000,lcxid=0x0)\n" +
+		" /127.0.0.1:54034[1](queued=0,recved=1,sent=1,sid=0x100012c5dc40001,lop=SESS,est=1485791245020,to=6000,lcxid=0x0)\n"
+	var command []byte
+	dial := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			command = make([]byte, 4)
+			io.ReadFull(server, command)
+			server.Write([]byte(cons))
+		}()
+		return client, nil
+	}
+	got, err := negotiatedTimeout(dial, "srv-1:2181", 0x100012c5dc40001, time.Second)
+	if err != nil {
+		t.Fatalf("negotiatedTimeout error %q", err)
+	}
+	if got != 6*time.Second {
+		t.Errorf("negotiatedTimeout == %s, want %s", got, 6*time.Second)
+	}
+	if string(command) != "cons" {
+		t.Errorf("negotiatedTimeout sent %q, want %q", command, "cons")
+	}
+	if _, err := negotiatedTimeout(dial, "srv-1:2181", 0x1, time.Second); err == nil {
+		t.Errorf("negotiatedTimeout of unlisted session succeeded, want error")
+	}
+}
+
+func TestServerMode(t *testing.T) {
+	cases := []struct {
+		response string
+		want     string
+	}{
+		{"Zookeeper version: 3.5.9\nLatency min/avg/max: 0/0/0\nMode: read-only\nNode count: 5\n", "read-only"},
+		{"Zookeeper version: 3.5.9\nMode: follower\n", "follower"},
+	}
+	for _, c := range cases {
+		response := c.response
+		dial := func(network, address string, timeout time.Duration) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				io.ReadFull(server, make([]byte, 4))
+				server.Write([]byte(response))
+			}()
+			return client, nil
+		}
+		if mode, err := serverMode(dial, "srv-1:2181", time.Second); err != nil || mode != c.want {
+			t.Errorf("serverMode == %q, %v, want %q", mode, err, c.want)
+		}
+	}
+}
+
+func TestDeleteRecursive(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/rmr/a/b", "/rmr/a/c", "/rmr/d"} {
+		if _, err := zook.Create(path, nil, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	if err := zook.DeleteRecursive("/rmr"); err != nil {
+		t.Errorf("DeleteRecursive error %q", err)
+	}
+	if exists, err := zook.Exists("/rmr"); err != nil || exists {
+		t.Errorf("Exists after DeleteRecursive == %t, %v, want false", exists, err)
+	}
+	if err := zook.DeleteRecursive("/rmr"); err == nil {
+		t.Errorf("DeleteRecursive of missing path succeeded, want error")
+	}
+}
+
+func TestDeleteRecursiveStreaming(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	createTestTree(t, zook, "/stream", 3, 3)
+	if _, err := zook.Create("/streamed", []byte{}, "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if err := zook.DeleteRecursiveStreaming("/stream"); err != nil {
+		t.Errorf("DeleteRecursiveStreaming error %q", err)
+	}
+	if exists, err := zook.Exists("/stream"); err != nil || exists {
+		t.Errorf("Exists after DeleteRecursiveStreaming == %t, %v, want false", exists, err)
+	}
+	if exists, err := zook.Exists("/streamed"); err != nil || !exists {
+		t.Errorf("Exists of sibling after DeleteRecursiveStreaming == %t, %v, want true", exists, err)
+	}
+	if err := zook.DeleteRecursiveStreaming("/stream"); err == nil {
+		t.Errorf("DeleteRecursiveStreaming of missing path succeeded, want error")
+	}
+	if err := zook.DeleteRecursiveStreaming("/"); err != errDeleteRoot {
+		t.Errorf("DeleteRecursiveStreaming(/) error %v, want %v", err, errDeleteRoot)
+	}
+	if exists, err := zook.Exists("/streamed"); err != nil || !exists {
+		t.Errorf("Exists after DeleteRecursiveStreaming(/) == %t, %v, want true", exists, err)
+	}
+}
+
+func TestValidateProvisionSpec(t *testing.T) {
+	data := "value"
+	valid := &ProvisionSpec{Nodes: []ProvisionNode{
+		{Path: "/app/config", Data: &data, ACL: "world:anyone:r"},
+		{Path: "/app/legacy", Delete: true},
+	}}
+	if err := NewZooKeeper().validateProvisionSpec(valid); err != nil {
+		t.Errorf("validateProvisionSpec error %q", err)
+	}
+	if valid.Nodes[0].acl == nil {
+		t.Errorf("validateProvisionSpec did not parse acl %q", valid.Nodes[0].ACL)
+	}
+	invalid := [][]ProvisionNode{
+		{{Path: "app"}},
+		{{Path: "/"}},
+		{{Path: "/app/"}},
+		{{Path: "/app"}, {Path: "/app"}},
+		{{Path: "/app", ACL: "world:anyone:x"}},
+		{{Path: "/app", Delete: true, Data: &data}},
+		{{Path: "/app", Delete: true}, {Path: "/app/config"}},
+	}
+	for _, nodes := range invalid {
+		if err := NewZooKeeper().validateProvisionSpec(&ProvisionSpec{Nodes: nodes}); err == nil {
+			t.Errorf("validateProvisionSpec(%+v) succeeded, want error", nodes)
+		}
+	}
+}
+
+func TestTransactionFailure(t *testing.T) {
+	ok := zk.MultiResponse{}
+	if failed := transactionFailure([]zk.MultiResponse{ok, ok}); failed != -1 {
+		t.Errorf("transactionFailure of successful responses == %d, want -1", failed)
+	}
+	responses := []zk.MultiResponse{ok, {Error: zk.ErrNodeExists}, {Error: zk.ErrUnknown}}
+	if failed := transactionFailure(responses); failed != 1 {
+		t.Errorf("transactionFailure == %d, want 1", failed)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	txn := zook.NewTransaction()
+	txn.Create("/txn", nil, "")
+	txn.Create("/txn/a", []byte("a"), "")
+	if _, err := txn.Commit(); err != nil {
+		t.Fatalf("Commit error %q", err)
+	}
+
+	txn = zook.NewTransaction()
+	txn.Create("/txn/b", []byte("b"), "")
+	txn.Create("/txn/a", []byte("again"), "")
+	_, err := txn.Commit()
+	if txnErr, ok := err.(*TransactionError); !ok || txnErr.Index != 1 || txnErr.Err != zk.ErrNodeExists {
+		t.Errorf("Commit error == %v, want a TransactionError at operation 1", err)
+	}
+	if exists, err := zook.Exists("/txn/b"); err != nil || exists {
+		t.Errorf("Exists of rolled back node == %t, %v, want false", exists, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	cache, err := zook.NewCache("/cached")
+	if err != nil {
+		t.Fatalf("NewCache error %q", err)
+	}
+	defer cache.Close()
+	if data := cache.Get(); data != nil {
+		t.Errorf("Get of missing node == %q, want nil", data)
+	}
+	waitFor := func(want string) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if string(cache.Get()) == want {
+				return
+			}
+		}
+		t.Errorf("Get == %q, want %q", cache.Get(), want)
+	}
+	if _, err := zook.Create("/cached", []byte("one"), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	waitFor("one")
+	if _, err := zook.Set("/cached", []byte("two")); err != nil {
+		t.Fatalf("Set error %q", err)
+	}
+	waitFor("two")
+	// closed again when deferred
+	cache.Close()
+}
+
+func TestCacheCloseTwice(t *testing.T) {
+	cache := &Cache{closed: make(chan struct{}), done: make(chan struct{})}
+	close(cache.done)
+	cache.Close()
+	cache.Close()
+	select {
+	case <-cache.closed:
+	default:
+		t.Error("Cache.Close did not close the cache")
+	}
+}
+
+func TestGenerateDigest(t *testing.T) {
+	// super:test is the example of ZooKeeper's administrator guide, for the superDigest setting
+	vectors := map[[2]string]string{
+		{"super", "test"}:    "super:D/InIHSb7yEEbrWz8b9l71RjZJU=",
+		{"bob", "secret"}:    "bob:fyVmFCwVbTJYrznoSu1koqYEYF0=",
+		{"user", "password"}: "user:tpUq/4Pn5A64fVZyQ0gOJ8ZWqkY=",
+	}
+	for credentials, want := range vectors {
+		if digest := GenerateDigest(credentials[0], credentials[1]); digest != want {
+			t.Errorf("GenerateDigest(%q, %q) == %q, want %q", credentials[0], credentials[1], digest, want)
+		}
+		if acl := zk.DigestACL(zk.PermAll, credentials[0], credentials[1]); acl[0].ID != want {
+			t.Errorf("zk.DigestACL(%q, %q) id == %q, want %q", credentials[0], credentials[1], acl[0].ID, want)
+		}
+	}
+}
+
+func TestExportImportSubtree(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for path, data := range map[string]string{"/exported/a": "a", "/exported/a/b": "b", "/exported/c": "c"} {
+		if _, err := zook.Create(path, []byte(data), "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	document, err := zook.ExportSubtree("/exported")
+	if err != nil {
+		t.Fatalf("ExportSubtree error %q", err)
+	}
+	if err := zook.ImportSubtree(document, false); err == nil {
+		t.Errorf("ImportSubtree over existing nodes succeeded, want error")
+	}
+	if err := zook.DeleteRecursive("/exported"); err != nil {
+		t.Fatalf("DeleteRecursive error %q", err)
+	}
+	if err := zook.ImportSubtree(document, false); err != nil {
+		t.Fatalf("ImportSubtree error %q", err)
+	}
+	if data, err := zook.Get("/exported/a/b"); err != nil || string(data) != "b" {
+		t.Errorf("Get after import == %q, %v, want %q", data, err, "b")
+	}
+	if reexported, err := zook.ExportSubtree("/exported"); err != nil || !bytes.Equal(reexported, document) {
+		t.Errorf("ExportSubtree after import == %s, %v, want %s", reexported, err, document)
+	}
+}
+
+func TestImportSubtreeReadOnlyParent(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	document, err := encodeExport(&Export{Root: "/readonly", Nodes: []ExportedNode{
+		{Path: "/readonly", Data: []byte("parent"), ACL: []string{"world:anyone:r"}},
+		{Path: "/readonly/child", Data: []byte("child"), ACL: []string{"world:anyone:cdrwa"}},
+		{Path: "/readonly/child/leaf", Data: []byte("leaf"), ACL: []string{"world:anyone:r"}},
+	}})
+	if err != nil {
+		t.Fatalf("encodeExport error %q", err)
+	}
+	if err := zook.ImportSubtree(document, false); err != nil {
+		t.Fatalf("ImportSubtree error %q", err)
+	}
+	for path, want := range map[string]string{"/readonly": "world:anyone:r", "/readonly/child": "world:anyone:cdrwa", "/readonly/child/leaf": "world:anyone:r"} {
+		if acl, err := zook.GetACL(path); err != nil || strings.Join(acl, ",") != want {
+			t.Errorf("GetACL(%q) == %q, %v, want %q", path, acl, err, want)
+		}
+	}
+	if data, err := zook.Get("/readonly/child/leaf"); err != nil || string(data) != "leaf" {
+		t.Errorf("Get after import == %q, %v, want %q", data, err, "leaf")
+	}
+}
+
+func TestChunked(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	if err := zook.SetChunked("/chunked", data, 100); err != nil {
+		t.Fatalf("SetChunked error %q", err)
+	}
+	if children, err := zook.Children("/chunked"); err != nil || len(children) != 3 {
+		t.Errorf("Children == %q, %v, want 3 chunks", children, err)
+	}
+	if result, err := zook.GetChunked("/chunked"); err != nil || !bytes.Equal(result, data) {
+		t.Errorf("GetChunked == %q, %v, want %q", result, err, data)
+	}
+	if err := zook.SetChunked("/chunked", []byte("short"), 100); err != nil {
+		t.Fatalf("SetChunked error %q", err)
+	}
+	if result, err := zook.GetChunked("/chunked"); err != nil || string(result) != "short" {
+		t.Errorf("GetChunked == %q, %v, want %q", result, err, "short")
+	}
+	var streamed bytes.Buffer
+	if err := zook.GetTo("/chunked", &streamed); err != nil || streamed.String() != "short" {
+		t.Errorf("GetTo == %q, %v, want %q", streamed.String(), err, "short")
+	}
+	if err := zook.Delete(chunkPath("/chunked", 0)); err != nil {
+		t.Fatalf("Delete error %q", err)
+	}
+	if result, err := zook.GetChunked("/chunked"); err == nil {
+		t.Errorf("GetChunked of incomplete chunks == %q, want error", result)
+	}
+}
+
+func TestWatchData(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer client.Close()
+	stopWatch := make(chan struct{})
+	events, err := client.WatchData("/watched", stopWatch)
+	if err != nil {
+		t.Fatalf("WatchData error %q", err)
+	}
+	expect := func(want zk.EventType) {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Errorf("WatchData event == %v, want %v", event.Type, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WatchData timed out waiting for %v", want)
+		}
+	}
+	if _, err := zook.Create("/watched", []byte("one"), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	expect(zk.EventNodeCreated)
+	if _, err := zook.Set("/watched", []byte("two")); err != nil {
+		t.Fatalf("Set error %q", err)
+	}
+	expect(zk.EventNodeDataChanged)
+	if err := zook.Delete("/watched"); err != nil {
+		t.Fatalf("Delete error %q", err)
+	}
+	expect(zk.EventNodeDeleted)
+	close(stopWatch)
+	if _, ok := <-events; ok {
+		t.Errorf("WatchData channel open after stop")
+	}
+}
+
+func TestValidateBackup(t *testing.T) {
+	zook := NewZooKeeper()
+	valid := `{"root": "/app", "nodes": [
+		{"path": "/app", "data": "", "acl": ["world:anyone:cdrwa"]},
+		{"path": "/app/config", "data": "YQ==", "acl": []},
+		{"path": "/app/config/db", "data": null, "acl": ["world:anyone:r"]}
+	]}`
+	if problems, err := zook.ValidateBackup([]byte(valid)); err != nil || len(problems) != 0 {
+		t.Errorf("ValidateBackup == %q, %v, want no problems", problems, err)
+	}
+	missingParent := `{"root": "/app", "nodes": [
+		{"path": "/app"},
+		{"path": "/app/config/db"}
+	]}`
+	problems, err := zook.ValidateBackup([]byte(missingParent))
+	if err != nil || len(problems) != 1 || !strings.Contains(problems[0], "missing parent /app/config") {
+		t.Errorf("ValidateBackup of missing parent == %q, %v, want a missing parent", problems, err)
+	}
+	inconsistent := `{"root": "/app", "nodes": [
+		{"path": "/app"},
+		{"path": "/app/"},
+		{"path": "/other"},
+		{"path": "/app/a"},
+		{"path": "/app/a"},
+		{"path": "/app/b", "acl": ["world:anyone:x"]}
+	]}`
+	if problems, err := zook.ValidateBackup([]byte(inconsistent)); err != nil || len(problems) != 4 {
+		t.Errorf("ValidateBackup == %q, %v, want 4 problems", problems, err)
+	}
+	if _, err := zook.ValidateBackup([]byte(`{"root": "/app", "nodes": [{"path": "/app", "data": "not base64!"}]}`)); err == nil {
+		t.Errorf("ValidateBackup of invalid base64 succeeded, want error")
+	}
+}
+
+func TestWatchChildren(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer client.Close()
+	if _, err := zook.Create("/services/a", nil, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	watch, err := client.WatchChildren("/services", nil)
+	if err != nil {
+		t.Fatalf("WatchChildren error %q", err)
+	}
+	expect := func(want string) {
+		select {
+		case children := <-watch.C:
+			if strings.Join(children, ",") != want {
+				t.Errorf("WatchChildren == %q, want %q", children, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WatchChildren timed out waiting for %q", want)
+		}
+	}
+	expect("a")
+	if _, err := zook.Create("/services/b", nil, "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	expect("a,b")
+	if err := zook.DeleteRecursive("/services"); err != nil {
+		t.Fatalf("DeleteRecursive error %q", err)
+	}
+	for range watch.C {
+	}
+	if err := watch.Err(); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("Err after deletion == %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCopyRecursive(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for path, data := range map[string]string{"/copy/v1": "v1", "/copy/v1/a": "a", "/copy/v1/a/b": "b"} {
+		if _, err := zook.Create(path, []byte(data), "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	if err := zook.CopyRecursive("/copy/v1", "/copy/v1/a/v2", true); err == nil {
+		t.Errorf("CopyRecursive into source succeeded, want error")
+	}
+	if err := zook.CopyRecursive("/copy/v1", "/copy/v2", false); err != nil {
+		t.Fatalf("CopyRecursive error %q", err)
+	}
+	if data, err := zook.Get("/copy/v2/a/b"); err != nil || string(data) != "b" {
+		t.Errorf("Get of copy == %q, %v, want %q", data, err, "b")
+	}
+	if err := zook.CopyRecursive("/copy/v1", "/copy/v2", false); err == nil {
+		t.Errorf("CopyRecursive onto existing destination succeeded, want error")
+	}
+	if err := zook.CopyRecursive("/copy/v1", "/copy/deep/v3", false); err == nil {
+		t.Errorf("CopyRecursive without parent of destination succeeded, want error")
+	}
+	if err := zook.CopyRecursive("/copy/v1", "/copy/deep/v3", true); err != nil {
+		t.Errorf("CopyRecursive with force error %q", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/rename/old", []byte("old"), "world:anyone:cdrw", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for path, data := range map[string]string{"/rename/old/a": "a", "/rename/old/a/b": "b"} {
+		if _, err := zook.Create(path, []byte(data), "", false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	if err := zook.Rename("/rename/old", "/rename/new"); err != nil {
+		t.Fatalf("Rename error %q", err)
+	}
+	for path, want := range map[string]string{"/rename/new": "old", "/rename/new/a": "a", "/rename/new/a/b": "b"} {
+		if data, err := zook.Get(path); err != nil || string(data) != want {
+			t.Errorf("Get(%q) == %q, %v, want %q", path, data, err, want)
+		}
+	}
+	if acl, err := zook.GetACL("/rename/new"); err != nil || strings.Join(acl, ",") != "world:anyone:cdrw" {
+		t.Errorf("GetACL of renamed == %q, %v, want %q", acl, err, "world:anyone:cdrw")
+	}
+	if exists, err := zook.Exists("/rename/old"); err != nil || exists {
+		t.Errorf("Exists of source after Rename == %v, %v, want false", exists, err)
+	}
+
+	if _, err := zook.Create("/rename/other", []byte("other"), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if err := zook.Rename("/rename/new", "/rename/other"); err == nil {
+		t.Errorf("Rename onto existing destination succeeded, want error")
+	}
+	if data, err := zook.Get("/rename/new/a/b"); err != nil || string(data) != "b" {
+		t.Errorf("Get of source after failed Rename == %q, %v, want %q", data, err, "b")
+	}
+	if children, err := zook.Children("/rename/other"); err != nil || len(children) != 0 {
+		t.Errorf("Children of destination after failed Rename == %q, %v, want none", children, err)
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	if _, err := LoadTLSConfig("", "client.pem", ""); err == nil {
+		t.Errorf("LoadTLSConfig of certificate without key succeeded, want error")
+	}
+	file, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("TempFile error %q", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not a certificate\n")
+	file.Close()
+	if _, err := LoadTLSConfig(file.Name(), "", ""); err == nil {
+		t.Errorf("LoadTLSConfig of invalid CA file succeeded, want error")
+	}
+	if cfg, err := LoadTLSConfig("", "", ""); err != nil || cfg.RootCAs != nil || len(cfg.Certificates) != 0 {
+		t.Errorf("LoadTLSConfig of no files == %+v, %v, want a default configuration", cfg, err)
+	}
+}
+
+func TestSetSASLConfig(t *testing.T) {
+	zook := NewZooKeeper()
+	authenticate := func(conn *zk.Conn, config SASLConfig) error { return nil }
+	if err := zook.SetSASLConfig(SASLConfig{Principal: "zkcli@EXAMPLE.COM"}, nil); err == nil {
+		t.Errorf("SetSASLConfig without authenticator succeeded, want error")
+	}
+	if err := zook.SetSASLConfig(SASLConfig{}, authenticate); err == nil {
+		t.Errorf("SetSASLConfig without principal succeeded, want error")
+	}
+	if err := zook.SetSASLConfig(SASLConfig{Principal: "zkcli@EXAMPLE.COM", Keytab: "/nonexistent/zkcli.keytab"}, authenticate); err == nil {
+		t.Errorf("SetSASLConfig with missing keytab succeeded, want error")
+	}
+	if err := zook.SetSASLConfig(SASLConfig{Principal: "zkcli@EXAMPLE.COM"}, authenticate); err != nil {
+		t.Errorf("SetSASLConfig error %q", err)
+	} else if zook.sasl.config.ServiceName != "zookeeper" {
+		t.Errorf("SetSASLConfig service name == %q, want %q", zook.sasl.config.ServiceName, "zookeeper")
+	}
+}
+
+// isErrorKind returns whether err is, or wraps, an error of given kind, or nil if kind is nil
+func isErrorKind(err error, kind error) bool {
+	if kind == nil {
+		return err == nil
+	}
+	return errors.Is(err, kind)
+}
+
+func TestWrapError(t *testing.T) {
+	err := wrapError("/a", zk.ErrNoNode)
+	zkErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("wrapError(zk.ErrNoNode) == %#v, want *Error", err)
+	}
+	if zkErr.Path != "/a" || zkErr.Unwrap() != zk.ErrNoNode || err.Error() != zk.ErrNoNode.Error() {
+		t.Errorf("wrapError(zk.ErrNoNode) == %#v", zkErr)
+	}
+	if !zkErr.Is(ErrNotFound) || zkErr.Is(ErrNodeExists) {
+		t.Errorf("wrapError(zk.ErrNoNode) is not only of kind ErrNotFound")
+	}
+	if wrapped := fmt.Errorf("cannot delete /a: %w", err); !errors.Is(wrapped, ErrNotFound) || !errors.Is(wrapped, zk.ErrNoNode) {
+		t.Errorf("errors.Is(%v) does not match ErrNotFound and zk.ErrNoNode", wrapped)
+	}
+	if err := wrapError("/a", zk.ErrConnectionClosed); err != zk.ErrConnectionClosed {
+		t.Errorf("wrapError(zk.ErrConnectionClosed) == %#v, want it unwrapped", err)
+	}
+	if err := wrapError("/a", nil); err != nil {
+		t.Errorf("wrapError(nil) == %#v, want nil", err)
+	}
+}
+
+func TestMaxFanout(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/fanout/a/1", "/fanout/b/1", "/fanout/b/2", "/fanout/b/3", "/fanout/c"} {
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	cases := []struct {
+		path      string
+		want      string
+		wantCount int32
+	}{
+		{"/fanout", "/fanout/b", 3},
+		{"/fanout/a", "/fanout/a", 1},
+		{"/fanout/c", "/fanout/c", 0},
+	}
+	for _, c := range cases {
+		widest, count, err := zook.MaxFanout(c.path)
+		if err != nil {
+			t.Errorf("MaxFanout(%q) error %q", c.path, err)
+		} else if widest != c.want || count != c.wantCount {
+			t.Errorf("MaxFanout(%q) == %q, %d, want %q, %d", c.path, widest, count, c.want, c.wantCount)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	// missing paths
+	notFound := map[string]func() error{
+		"GetLimited":                func() error { _, err := zook.GetLimited("/missing", 10); return err },
+		"MaxFanout":                 func() error { _, _, err := zook.MaxFanout("/missing"); return err },
+		"OldestNodes":               func() error { _, err := zook.OldestNodes("/missing", 1); return err },
+		"OldestNode":                func() error { _, _, err := zook.OldestNode("/missing"); return err },
+		"RequireNonEmptyLeaves":     func() error { _, err := zook.RequireNonEmptyLeaves("/missing"); return err },
+		"CheckIntegrity":            func() error { _, err := zook.CheckIntegrity("/missing"); return err },
+		"DeleteRecursiveWithDryRun": func() error { _, err := zook.DeleteRecursiveWithDryRun("/missing", false); return err },
+		"DeleteRecursiveStreaming":  func() error { return zook.DeleteRecursiveStreaming("/missing") },
+		"Rename":                    func() error { return zook.Rename("/missing", "/renamed") },
+		"ChildrenRecursive":         func() error { _, err := zook.ChildrenRecursive("/missing"); return err },
+		"ChildrenByCreation":        func() error { _, err := zook.ChildrenByCreation("/missing"); return err },
+		"AllChildrenCount":          func() error { _, err := zook.AllChildrenCount("/missing"); return err },
+		"SetWithBackup":             func() error { _, err := zook.SetWithBackup("/missing", []byte{}); return err },
+		"CompareAndAdvance":         func() error { _, err := zook.CompareAndAdvance("/missing", nil, nil); return err },
+		"FindWorldWritable":         func() error { _, err := zook.FindWorldWritable("/missing"); return err },
+		"FindACLReferences":         func() error { _, err := zook.FindACLReferences("/missing", "world", "anyone", ACLIDExact); return err },
+		"EffectiveAccess":           func() error { _, err := zook.EffectiveAccess("/missing"); return err },
+		"GetACLRecursive":           func() error { _, err := zook.GetACLRecursive("/missing"); return err },
+		"EnsureACLEntry":            func() error { _, err := zook.EnsureACLEntry("/missing", "world", "anyone", "r", true); return err },
+		"ReplaceACLIdentity": func() error {
+			_, err := zook.ReplaceACLIdentity("/missing", "world", "anyone", "auth", "", true)
+			return err
+		},
+		"SetACLRecursive":    func() error { _, err := zook.SetACLRecursive("/missing", "world:anyone:r", false); return err },
+		"EphemeralsOwnedBy":  func() error { _, err := zook.EphemeralsOwnedBy("/missing", 1); return err },
+		"ExportSubtree":      func() error { _, err := zook.ExportSubtree("/missing"); return err },
+		"CopyRecursive":      func() error { return zook.CopyRecursive("/missing", "/copied", false) },
+		"ArchiveOldChildren": func() error { _, err := zook.ArchiveOldChildren("/missing", 0, "/archived"); return err },
+		"SetTagged":          func() error { _, err := zook.SetTagged("/missing", nil, nil); return err },
+		"CleanupByMarker":    func() error { _, err := zook.CleanupByMarker("/missing", nil, true); return err },
+	}
+	for name, f := range notFound {
+		if err := f(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s of missing path error %v, want %v", name, err, ErrNotFound)
+		}
+	}
+
+	// existing destination
+	for _, path := range []string{"/typed/a", "/typed/b"} {
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	if err := zook.Rename("/typed/a", "/typed/b"); !errors.Is(err, ErrNodeExists) {
+		t.Errorf("Rename onto existing path error %v, want %v", err, ErrNodeExists)
+	}
+
+	// missing permissions, on a child deleted, or a node imported over
+	if _, err := zook.Create("/typed/protected/child", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if _, err := zook.SetACL("/typed/protected", "world:anyone:rca", false); err != nil {
+		t.Fatalf("SetACL error %q", err)
+	}
+	if _, err := zook.DeleteRecursiveWithDryRun("/typed/protected", false); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("DeleteRecursiveWithDryRun of protected child error %v, want %v", err, ErrNotAuthenticated)
+	}
+	if err := zook.DeleteRecursiveStreaming("/typed/protected"); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("DeleteRecursiveStreaming of protected child error %v, want %v", err, ErrNotAuthenticated)
+	} else if zkErr := (*Error)(nil); !errors.As(err, &zkErr) || zkErr.Path != "/typed/protected/child" {
+		t.Errorf("DeleteRecursiveStreaming of protected child error %#v, want it on /typed/protected/child", err)
+	}
+	document, err := zook.ExportSubtree("/typed/protected")
+	if err != nil {
+		t.Fatalf("ExportSubtree error %q", err)
+	}
+	if _, err := zook.SetACL("/typed/protected/child", "world:anyone:r", false); err != nil {
+		t.Fatalf("SetACL error %q", err)
+	}
+	if err := zook.ImportSubtree(document, true); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("ImportSubtree over read only node error %v, want %v", err, ErrNotAuthenticated)
+	}
+
+	// missing permissions deep in a walk
+	if _, err := zook.Create("/typed/unreadable/child", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if _, err := zook.SetACL("/typed/unreadable/child", "world:anyone:cdwa", false); err != nil {
+		t.Fatalf("SetACL error %q", err)
+	}
+	if _, err := zook.ChildrenRecursive("/typed/unreadable"); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("ChildrenRecursive over unreadable child error %v, want %v", err, ErrNotAuthenticated)
+	}
+}
+
+func TestWrappedErrorKinds(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind error
+	}{
+		{fmt.Errorf("%s: %w", "/a", wrapError("/a", zk.ErrNotEmpty)), ErrNotEmpty},
+		{fmt.Errorf("%s: %w", "/a", wrapError("/a", zk.ErrNotEmpty)), zk.ErrNotEmpty},
+		{MultiError{errors.New("other"), fmt.Errorf("%s: %w", "/b", wrapError("/b", zk.ErrNoNode))}, ErrNotFound},
+		{&TransactionError{Index: 1, Op: "set", Path: "/c", Err: zk.ErrBadVersion}, ErrBadVersion},
+		{&TransactionError{Index: 1, Op: "set", Path: "/c", Err: zk.ErrBadVersion}, zk.ErrBadVersion},
+	}
+	for _, c := range cases {
+		if !errors.Is(c.err, c.kind) {
+			t.Errorf("errors.Is(%v, %v) == false, want true", c.err, c.kind)
+		}
+	}
+	multi := MultiError{errors.New("other")}
+	if err := wrapError("/d", multi); !errors.Is(err, multi[0]) || errors.Is(err, ErrNotFound) {
+		t.Errorf("wrapError(MultiError) == %v, want it as is", err)
+	}
+}
+
+func TestSplitChroot(t *testing.T) {
+	cases := []struct {
+		servers     string
+		wantServers string
+		wantChroot  string
+	}{
+		{"zk1:2181,zk2:2181", "zk1:2181,zk2:2181", ""},
+		{"zk1:2181/app,zk2:2181/app", "zk1:2181,zk2:2181", "/app"},
+		{"zk1:2181,zk2:2181/app/", "zk1:2181,zk2:2181", "/app"},
+		{"zk1/app/config,zk2", "zk1,zk2", "/app/config"},
+		{"zk1:2181/", "zk1:2181", ""},
+	}
+	for _, c := range cases {
+		servers, chroot, err := SplitChroot(strings.Split(c.servers, ","))
+		if err != nil {
+			t.Errorf("SplitChroot(%q) error %q", c.servers, err)
+		} else if strings.Join(servers, ",") != c.wantServers || chroot != c.wantChroot {
+			t.Errorf("SplitChroot(%q) == %q, %q, want %q, %q", c.servers, servers, chroot, c.wantServers, c.wantChroot)
+		}
+	}
+	if _, _, err := SplitChroot([]string{"zk1:2181/app", "zk2:2181/other"}); err == nil {
+		t.Errorf("SplitChroot of different chroots: want error")
+	}
+}
+
+func TestChroot(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	server := zook.getServers()[0]
+	chrooted := NewZooKeeper()
+	chrooted.SetServers([]string{server + "/app"})
+	if _, err := chrooted.Exists("/"); err == nil {
+		t.Errorf("Exists over chrooted servers: want error")
+	}
+
+	servers, chroot, err := SplitChroot([]string{server + "/app"})
+	if err != nil {
+		t.Fatalf("SplitChroot error %q", err)
+	}
+	chrooted.SetServers(servers)
+	if _, err := chrooted.Create(gopath.Join(chroot, "/config"), []byte("value"), "", true); err != nil {
+		t.Fatalf("Create under chroot error %q", err)
+	}
+	if got, err := zook.Get("/app/config"); err != nil || string(got) != "value" {
+		t.Errorf("Get(/app/config) == %q, %v, want %q", got, err, "value")
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/many/a", "/many/b"} {
+		if _, err := zook.Create(path, []byte(path), "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	result, err := zook.GetMany([]string{"/many/a", "/many/b", "/many/missing"})
+	if err != nil {
+		t.Fatalf("GetMany error %q", err)
+	}
+	if len(result) != 2 || string(result["/many/a"]) != "/many/a" || string(result["/many/b"]) != "/many/b" {
+		t.Errorf("GetMany == %q, want /many/a and /many/b only", result)
+	}
+}
+
+func TestExistsMany(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/required", []byte{}, "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	result, err := zook.ExistsMany([]string{"/required", "/missing"})
+	if err != nil {
+		t.Fatalf("ExistsMany error %q", err)
+	}
+	if len(result) != 2 || !result["/required"] || result["/missing"] {
+		t.Errorf("ExistsMany == %v, want /required only existing", result)
+	}
+
+	zook.SetServers([]string{"127.0.0.1:1/chroot"})
+	if _, err := zook.ExistsMany([]string{"/required"}); err == nil {
+		t.Errorf("ExistsMany without a connection: want error")
+	}
+}
+
+func TestChildrenWithStat(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, name := range []string{"b", "a"} {
+		if _, err := zook.Create("/listing/"+name, []byte(name+name), "", true); err != nil {
+			t.Fatalf("Create error %q", err)
+		}
+	}
+	result, err := zook.ChildrenWithStat("/listing")
+	if err != nil {
+		t.Fatalf("ChildrenWithStat error %q", err)
+	}
+	if len(result) != 2 || result[0].Name != "a" || result[1].Name != "b" {
+		t.Fatalf("ChildrenWithStat == %+v, want a, b", result)
+	}
+	if result[0].Stat.DataLength != 2 || result[0].Stat.EphemeralOwner != 0 {
+		t.Errorf("ChildrenWithStat stat of a == %+v", result[0].Stat)
+	}
+	if _, err := zook.ChildrenWithStat("/missing"); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("ChildrenWithStat(/missing) error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSubtreeStats(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/stats", []byte("1"), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if _, err := zook.Create("/stats/a/b", []byte("12"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	nodeCount, totalBytes, maxDepth, err := zook.SubtreeStats("/stats")
+	if err != nil {
+		t.Fatalf("SubtreeStats error %q", err)
+	}
+	wantBytes := int64(1 + len(defaultAutoParentData) + 2)
+	if nodeCount != 3 || totalBytes != wantBytes || maxDepth != 2 {
+		t.Errorf("SubtreeStats == %d, %d, %d, want 3, %d, 2", nodeCount, totalBytes, maxDepth, wantBytes)
+	}
+}
+
+func TestCreateWithParentACL(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	leafACL := zk.WorldACL(zk.PermAll)
+	parentACL := zk.WorldACL(zk.PermRead | zk.PermCreate)
+	if _, err := zook.CreateWithParentACL("/locked/down/leaf", []byte("secret"), leafACL, parentACL, 0); err != nil {
+		t.Fatalf("CreateWithParentACL error %q", err)
+	}
+	for path, want := range map[string][]zk.ACL{"/locked": parentACL, "/locked/down": parentACL, "/locked/down/leaf": leafACL} {
+		connection, err := zook.connect()
+		if err != nil {
+			t.Fatalf("connect error %q", err)
+		}
+		acl, _, err := connection.GetACL(path)
+		connection.Close()
+		if err != nil || !ACLEqual(acl, want) {
+			t.Errorf("ACL of %s == %v, %v, want %v", path, acl, err, want)
+		}
+	}
+	if _, err := zook.CreateWithParentACL("/locked/down/leaf", []byte{}, leafACL, parentACL, 0); !isErrorKind(err, ErrNodeExists) {
+		t.Errorf("CreateWithParentACL of existing path error %v, want %v", err, ErrNodeExists)
+	}
+}
+
+func TestInheritParentACL(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	restrictedACL := zk.WorldACL(zk.PermRead | zk.PermCreate | zk.PermAdmin)
+	if _, err := zook.Create("/restricted", []byte{}, "world:anyone:rca", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	zook.SetInheritParentACL(true)
+	if _, err := zook.Create("/restricted/gap/leaf", []byte("leaf"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for path, want := range map[string][]zk.ACL{"/restricted/gap": restrictedACL, "/restricted/gap/leaf": zook.acl} {
+		connection, err := zook.connect()
+		if err != nil {
+			t.Fatalf("connect error %q", err)
+		}
+		acl, _, err := connection.GetACL(path)
+		connection.Close()
+		if err != nil || !ACLEqual(acl, want) {
+			t.Errorf("ACL of %s == %v, %v, want %v", path, acl, err, want)
+		}
+	}
+}
+
+func TestSetAutoParentData(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	zook.SetAutoParentData(nil)
+	if _, err := zook.Create("/empty/parent/leaf", []byte("leaf"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for _, path := range []string{"/empty", "/empty/parent"} {
+		if data, err := zook.Get(path); err != nil || len(data) != 0 {
+			t.Errorf("Get(%q) == %q, %v, want empty", path, data, err)
+		}
+	}
+}
+
+func TestCreateMissingAncestors(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/a/b/c/d", []byte("leaf"), "", false); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("Create without force error %v, want %v", err, ErrNotFound)
+	}
+	if _, err := zook.Create("/a/b/c/d", []byte("leaf"), "world:anyone:rcd", true); err != nil {
+		t.Fatalf("Create with force error %q", err)
+	}
+	for _, path := range []string{"/a", "/a/b", "/a/b/c"} {
+		if data, err := zook.Get(path); err != nil || string(data) != defaultAutoParentData {
+			t.Errorf("Get(%q) == %q, %v, want %q", path, data, err, defaultAutoParentData)
+		}
+	}
+	if data, err := zook.Get("/a/b/c/d"); err != nil || string(data) != "leaf" {
+		t.Errorf("Get(/a/b/c/d) == %q, %v, want %q", data, err, "leaf")
+	}
+	if acl, err := zook.GetACL("/a/b/c/d"); err != nil || len(acl) != 1 || acl[0] != "world:anyone:cdr" {
+		t.Errorf("GetACL(/a/b/c/d) == %q, %v, want world:anyone:cdr", acl, err)
+	}
+
+	if _, err := zook.CreateWithACL("/x/y/z", []byte("leaf"), true, zk.WorldACL(zk.PermAll)); err != nil {
+		t.Fatalf("CreateWithACL with force error %q", err)
+	}
+	if data, err := zook.Get("/x/y"); err != nil || string(data) != defaultAutoParentData {
+		t.Errorf("Get(/x/y) == %q, %v, want %q", data, err, defaultAutoParentData)
+	}
+	if _, err := zook.Create("/a/b/c/d", []byte("again"), "", true); !isErrorKind(err, ErrNodeExists) {
+		t.Errorf("Create of existing path error %v, want %v", err, ErrNodeExists)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/dry/a/x", "/dry/b"} {
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	plan, err := zook.DeleteRecursiveWithDryRun("/dry", true)
+	want := []string{"/dry/b", "/dry/a/x", "/dry/a", "/dry"}
+	if err != nil || strings.Join(plan, ",") != strings.Join(want, ",") {
+		t.Errorf("DeleteRecursiveWithDryRun == %q, %v, want %q", plan, err, want)
+	}
+	if exists, err := zook.Exists("/dry/a/x"); err != nil || !exists {
+		t.Errorf("DeleteRecursiveWithDryRun deleted /dry/a/x")
+	}
+
+	plan, err = zook.SetACLWithDryRun("/dry/c/d", "world:anyone:r", true, true)
+	if err != nil || strings.Join(plan, ",") != "/dry/c,/dry/c/d" {
+		t.Errorf("SetACLWithDryRun == %q, %v, want /dry/c, /dry/c/d", plan, err)
+	}
+	if exists, err := zook.Exists("/dry/c"); err != nil || exists {
+		t.Errorf("SetACLWithDryRun created /dry/c")
+	}
+	if _, err := zook.SetACLWithDryRun("/dry/c/d", "world:anyone:r", false, true); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("SetACLWithDryRun without force error %v, want %v", err, ErrNotFound)
+	}
+
+	deleted, err := zook.DeleteRecursiveWithDryRun("/dry", false)
+	if err != nil || strings.Join(deleted, ",") != strings.Join(want, ",") {
+		t.Errorf("DeleteRecursiveWithDryRun == %q, %v, want %q", deleted, err, want)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	zook := NewZooKeeper()
+	if err := zook.SetRetryPolicy(0, time.Millisecond); err == nil {
+		t.Errorf("SetRetryPolicy(0) want error")
+	}
+	if err := zook.SetRetryPolicy(3, time.Millisecond); err != nil {
+		t.Fatalf("SetRetryPolicy error %q", err)
+	}
+	cases := []struct {
+		err          error
+		wantAttempts int
+	}{
+		{zk.ErrConnectionClosed, 3},
+		{zk.ErrSessionMoved, 3},
+		{zk.ErrNoNode, 1},
+		{zk.ErrNodeExists, 1},
+		{nil, 1},
+	}
+	for _, c := range cases {
+		attempts := 0
+		err := zook.retry(func() error {
+			attempts++
+			return c.err
+		})
+		if err != c.err || attempts != c.wantAttempts {
+			t.Errorf("retry of %v == %v after %d attempts, want %d attempts", c.err, err, attempts, c.wantAttempts)
+		}
+	}
+	attempts := 0
+	err := zook.retry(func() error {
+		if attempts++; attempts < 2 {
+			return zk.ErrConnectionClosed
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("retry of a recovering request == %v after %d attempts, want success after 2", err, attempts)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	timeout := time.After(5 * time.Second)
+	for hasSession := false; !hasSession; {
+		select {
+		case event := <-client.Events():
+			hasSession = event.Type == zk.EventSession && event.State == zk.StateHasSession
+		case <-timeout:
+			t.Fatalf("no StateHasSession event")
+		}
+	}
+	client.Close()
+	for range client.Events() {
+	}
+}
+
+func TestRootPath(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/top/child", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if result, err := zook.Create("/", []byte{}, "", false); err != nil || result != "/" {
+		t.Errorf("Create(/) == %q, %v, want /", result, err)
+	}
+	if exists, err := zook.Exists("/"); err != nil || !exists {
+		t.Errorf("Exists(/) == %v, %v, want true", exists, err)
+	}
+	children, err := zook.Children("/")
+	if err != nil {
+		t.Fatalf("Children(/) error %q", err)
+	}
+	sort.Strings(children)
+	if strings.Join(children, ",") != "top,zookeeper" {
+		t.Errorf("Children(/) == %q, want top, zookeeper", children)
+	}
+	descendants, err := zook.ChildrenRecursive("/")
+	if err != nil {
+		t.Fatalf("ChildrenRecursive(/) error %q", err)
+	}
+	if !strings.Contains(strings.Join(descendants, ","), "top,top/child,zookeeper") {
+		t.Errorf("ChildrenRecursive(/) == %q, want top, top/child, zookeeper and its descendants", descendants)
+	}
+	if err := zook.Delete("/"); err != errDeleteRoot {
+		t.Errorf("Delete(/) error %v, want %v", err, errDeleteRoot)
+	}
+	if err := zook.DeleteRecursive("/"); err != errDeleteRoot {
+		t.Errorf("DeleteRecursive(/) error %v, want %v", err, errDeleteRoot)
+	}
+	if _, err := zook.DeleteRecursiveWithDryRun("/", true); err != errDeleteRoot {
+		t.Errorf("DeleteRecursiveWithDryRun(/) error %v, want %v", err, errDeleteRoot)
+	}
+	if exists, err := zook.Exists("/top/child"); err != nil || !exists {
+		t.Errorf("Exists(/top/child) after deleting / == %v, %v, want true", exists, err)
+	}
+}
+
+func TestPreOrderLess(t *testing.T) {
+	paths := []string{"b", "a-b", "a/x/y", "a", "a/x", "a/b", "a-b/c"}
+	sort.Slice(paths, func(i, j int) bool { return preOrderLess(paths[i], paths[j]) })
+	want := "a,a/b,a/x,a/x/y,a-b,a-b/c,b"
+	if got := strings.Join(paths, ","); got != want {
+		t.Errorf("sorted by preOrderLess == %s, want %s", got, want)
+	}
+}
+
+// createTestTree creates under root a tree of given fanout and depth
+func createTestTree(t testing.TB, zook *ZooKeeper, root string, fanout int, depth int) {
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < fanout; i++ {
+		path := fmt.Sprintf("%s/node-%d", root, i)
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+		createTestTree(t, zook, path, fanout, depth-1)
+	}
+}
+
+func TestChildrenRecursiveParallel(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	createTestTree(t, zook, "/tree", 3, 3)
+	if _, err := zook.Create("/tree/node-1-b/leaf", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	want, err := zook.ChildrenRecursive("/tree")
+	if err != nil {
+		t.Fatalf("ChildrenRecursive error %q", err)
+	}
+	got, err := zook.ChildrenRecursiveParallel("/tree", 4)
+	if err != nil {
+		t.Fatalf("ChildrenRecursiveParallel error %q", err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ChildrenRecursiveParallel == %q, want %q", got, want)
+	}
+	if _, err := zook.ChildrenRecursiveParallel("/missing", 4); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("ChildrenRecursiveParallel(/missing) error %v, want %v", err, ErrNotFound)
+	}
+}
+
+// benchmarkTreeFanout and benchmarkTreeDepth size the tree the listing benchmarks walk: 10 + 100 + 1000 nodes.
+// Raise them, e.g. to 35 and 3 for a tree of 44k nodes, for figures representative of large trees.
+const (
+	benchmarkTreeFanout = 10
+	benchmarkTreeDepth  = 3
+)
+
+func BenchmarkChildrenRecursive(b *testing.B) {
+	zook, stop := startTestZooKeeper(b)
+	defer stop()
+	createTestTree(b, zook, "/tree", benchmarkTreeFanout, benchmarkTreeDepth)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := zook.ChildrenRecursive("/tree"); err != nil {
+			b.Fatalf("ChildrenRecursive error %q", err)
+		}
+	}
+}
+
+func BenchmarkChildrenRecursiveParallel(b *testing.B) {
+	zook, stop := startTestZooKeeper(b)
+	defer stop()
+	createTestTree(b, zook, "/tree", benchmarkTreeFanout, benchmarkTreeDepth)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := zook.ChildrenRecursiveParallel("/tree", maxConcurrency); err != nil {
+			b.Fatalf("ChildrenRecursiveParallel error %q", err)
+		}
+	}
+}
+
+func TestChildrenCount(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	createTestTree(t, zook, "/wide", 5, 1)
+	if count, err := zook.ChildrenCount("/wide"); err != nil || count != 5 {
+		t.Errorf("ChildrenCount(/wide) == %d, %v, want 5", count, err)
+	}
+	if _, err := zook.ChildrenCount("/missing"); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("ChildrenCount(/missing) error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestIsEphemeral(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer client.Close()
+	if _, err := zook.Create("/sessions/persistent", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	for _, path := range []string{"/sessions/lock-1", "/sessions/lock-2"} {
+		if _, err := client.CreateEphemeral(path, []byte{}, ""); err != nil {
+			t.Fatalf("CreateEphemeral(%q) error %q", path, err)
+		}
+	}
+	ephemeral, owner, err := zook.IsEphemeral("/sessions/lock-1")
+	if err != nil || !ephemeral || owner == 0 {
+		t.Fatalf("IsEphemeral(/sessions/lock-1) == %v, %d, %v, want true and an owner", ephemeral, owner, err)
+	}
+	if ephemeral, owner, err := zook.IsEphemeral("/sessions/persistent"); err != nil || ephemeral || owner != 0 {
+		t.Errorf("IsEphemeral(/sessions/persistent) == %v, %d, %v, want false, 0", ephemeral, owner, err)
+	}
+	counts, err := zook.EphemeralCounts("/sessions")
+	if err != nil || len(counts) != 1 || counts[owner] != 2 {
+		t.Errorf("EphemeralCounts == %v, %v, want 2 of session %d", counts, err, owner)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	stat, err := zook.Upsert("/upsert/key", []byte("1"), "", true)
+	if err != nil || stat.Version != 0 {
+		t.Fatalf("Upsert of missing path == %+v, %v, want version 0", stat, err)
+	}
+	stat, err = zook.Upsert("/upsert/key", []byte("2"), "", true)
+	if err != nil || stat.Version != 1 {
+		t.Fatalf("Upsert of existing path == %+v, %v, want version 1", stat, err)
+	}
+	if data, err := zook.Get("/upsert/key"); err != nil || string(data) != "2" {
+		t.Errorf("Get == %q, %v, want %q", data, err, "2")
+	}
+
+	if created, err := zook.CreateIfNotExists("/upsert/key", []byte("3"), "", false); err != nil || created {
+		t.Errorf("CreateIfNotExists of existing path == %v, %v, want false", created, err)
+	}
+	if data, err := zook.Get("/upsert/key"); err != nil || string(data) != "2" {
+		t.Errorf("Get after CreateIfNotExists == %q, %v, want %q", data, err, "2")
+	}
+	if created, err := zook.CreateIfNotExists("/upsert/other", []byte("3"), "", false); err != nil || !created {
+		t.Errorf("CreateIfNotExists of missing path == %v, %v, want true", created, err)
+	}
+	if _, err := zook.CreateIfNotExists("/missing/parent", []byte{}, "", false); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("CreateIfNotExists without parent error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCreateAndStat(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	created, stat, err := zook.CreateAndStat("/stat/seq-", []byte("value"), "", true, zk.FlagSequence)
+	if err != nil {
+		t.Fatalf("CreateAndStat error %q", err)
+	}
+	if !strings.HasPrefix(created, "/stat/seq-") || created == "/stat/seq-" {
+		t.Errorf("CreateAndStat created %q, want a sequential name", created)
+	}
+	if stat.Version != 0 || stat.DataLength != int32(len("value")) {
+		t.Errorf("CreateAndStat stat == %+v, want version 0 and length %d", stat, len("value"))
+	}
+	if _, _, err := zook.CreateAndStat("/missing/parent", []byte{}, "", false, 0); !isErrorKind(err, ErrNotFound) {
+		t.Errorf("CreateAndStat without parent error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMyEphemerals(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/sessions/persistent", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer client.Close()
+	other, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	defer other.Close()
+	if _, err := client.CreateEphemeral("/sessions/mine", []byte{}, ""); err != nil {
+		t.Fatalf("CreateEphemeral error %q", err)
+	}
+	if _, err := other.CreateEphemeral("/sessions/other", []byte{}, ""); err != nil {
+		t.Fatalf("CreateEphemeral error %q", err)
+	}
+	if ephemerals, err := client.MyEphemerals("/sessions"); err != nil || strings.Join(ephemerals, ",") != "/sessions/mine" {
+		t.Errorf("MyEphemerals == %q, %v, want %q", ephemerals, err, "/sessions/mine")
+	}
+}
+
+func TestCreateProtectedEphemeralSequential(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/recipe", []byte{}, "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	client, err := zook.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient error %q", err)
+	}
+	created, err := client.CreateProtectedEphemeralSequential("/recipe/lock-", []byte{}, "")
+	if err != nil {
+		t.Fatalf("CreateProtectedEphemeralSequential error %q", err)
+	}
+	name := gopath.Base(created)
+	if gopath.Dir(created) != "/recipe" || !strings.HasPrefix(name, "_c_") || !strings.Contains(name, "-lock-") {
+		t.Errorf("CreateProtectedEphemeralSequential created %q, want /recipe/_c_<guid>-lock-<sequence>", created)
+	}
+	if exists, err := zook.Exists(created); err != nil || !exists {
+		t.Errorf("Exists(%q) == %v, %v, want true", created, exists, err)
+	}
+	client.Close()
+	if exists, err := zook.Exists(created); err != nil || exists {
+		t.Errorf("Exists(%q) after Close == %v, %v, want false", created, exists, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	first, second := zook.NewLock(), zook.NewLock()
+	if err := first.Acquire("/locks/demo", time.Second); err != nil {
+		t.Fatalf("Acquire error %q", err)
+	}
+	if err := second.Acquire("/locks/demo", 100*time.Millisecond); err == nil {
+		t.Fatalf("Acquire of held lock succeeded")
+	}
+	if children, err := zook.Children("/locks/demo"); err != nil || len(children) != 1 {
+		t.Errorf("Children after timed out Acquire == %q, %v, want first lock's node only", children, err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- second.Acquire("/locks/demo", 5*time.Second)
+	}()
+	if err := first.Release(); err != nil {
+		t.Fatalf("Release error %q", err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire of released lock error %q", err)
+	}
+
+	// the node going away loses the lock
+	if err := zook.Delete(second.node); err != nil {
+		t.Fatalf("Delete error %q", err)
+	}
+	select {
+	case <-second.Lost():
+	case <-time.After(5 * time.Second):
+		t.Errorf("Lost not closed after lock's node was deleted")
+	}
+	if err := second.Release(); err != nil {
+		t.Errorf("Release of lost lock error %q", err)
+	}
+	if err := second.Release(); err == nil {
+		t.Errorf("Release of released lock succeeded")
+	}
+}
+
+func TestLockSequence(t *testing.T) {
+	for name, want := range map[string]string{
+		"_c_0123456789abcdef0123456789abcdef-lock-0000000042": "0000000042",
+		"lock-0000000001": "0000000001",
+		"short":           "short",
+	} {
+		if got := lockSequence(name); got != want {
+			t.Errorf("lockSequence(%q) == %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCreatePlanned(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	paths := map[string][]byte{"/planned/a/b": []byte("b"), "/planned/c": []byte("c")}
+	if err := zook.CreatePlanned(paths, "", false); err != nil {
+		t.Fatalf("CreatePlanned error %q", err)
+	}
+	want := map[string]string{"/planned": defaultAutoParentData, "/planned/a": defaultAutoParentData, "/planned/a/b": "b", "/planned/c": "c"}
+	for path, wantData := range want {
+		if data, err := zook.Get(path); err != nil {
+			t.Errorf("Get(%q) error %q", path, err)
+		} else if string(data) != wantData {
+			t.Errorf("Get(%q) == %q, want %q", path, data, wantData)
+		}
+	}
+	// Parents are created before their children
+	for _, parentChild := range [][2]string{{"/planned", "/planned/a"}, {"/planned/a", "/planned/a/b"}, {"/planned", "/planned/c"}} {
+		parent, err := zook.Stat(parentChild[0])
+		if err != nil {
+			t.Fatalf("Stat(%q) error %q", parentChild[0], err)
+		}
+		child, err := zook.Stat(parentChild[1])
+		if err != nil {
+			t.Fatalf("Stat(%q) error %q", parentChild[1], err)
+		}
+		if parent.Czxid >= child.Czxid {
+			t.Errorf("%s created at zxid %d, not before %s at %d", parentChild[0], parent.Czxid, parentChild[1], child.Czxid)
+		}
+	}
+
+	existing := map[string][]byte{"/planned/c": []byte("new"), "/planned/d": []byte("d")}
+	if err := zook.CreatePlanned(existing, "", false); err == nil {
+		t.Errorf("CreatePlanned with an existing target succeeded, want error")
+	}
+	if exists, err := zook.Exists("/planned/d"); err != nil || exists {
+		t.Errorf("Exists(%q) after failed CreatePlanned == %t, %v, want false", "/planned/d", exists, err)
+	}
+	if err := zook.CreatePlanned(existing, "", true); err != nil {
+		t.Fatalf("CreatePlanned with force error %q", err)
+	}
+	for path, wantData := range map[string]string{"/planned/c": "new", "/planned/d": "d"} {
+		if data, err := zook.Get(path); err != nil || string(data) != wantData {
+			t.Errorf("Get(%q) after forced CreatePlanned == %q, %v, want %q", path, data, err, wantData)
+		}
+	}
+}
+
+func TestInitializeOnce(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	initialized, err := zook.InitializeOnce("/init", map[string][]byte{"config": []byte("v1"), "a/b": []byte("b")}, "")
+	if err != nil || !initialized {
+		t.Fatalf("InitializeOnce == %t, %v, want true", initialized, err)
+	}
+	initialized, err = zook.InitializeOnce("/init", map[string][]byte{"config": []byte("v2"), "other": []byte("o")}, "")
+	if err != nil || initialized {
+		t.Errorf("second InitializeOnce == %t, %v, want false", initialized, err)
+	}
+	for path, wantData := range map[string]string{"/init/config": "v1", "/init/a": defaultAutoParentData, "/init/a/b": "b"} {
+		if data, err := zook.Get(path); err != nil || string(data) != wantData {
+			t.Errorf("Get(%q) == %q, %v, want %q", path, data, err, wantData)
+		}
+	}
+	if exists, err := zook.Exists("/init/other"); err != nil || exists {
+		t.Errorf("Exists(%q) after second InitializeOnce == %t, %v, want false", "/init/other", exists, err)
+	}
+}
+
+func TestWaitForNoChildrenTimeout(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/wait/child", []byte{}, "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	start := time.Now()
+	if empty, err := zook.WaitForNoChildren("/wait", 200*time.Millisecond); err != nil || empty {
+		t.Errorf("WaitForNoChildren == %t, %v, want false", empty, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("WaitForNoChildren returned after %s, want at least %s", elapsed, 200*time.Millisecond)
+	}
+}
+
+func TestWaitForNoChildrenRemoved(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/wait/a", "/wait/b"} {
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	go func() {
+		for _, path := range []string{"/wait/a", "/wait/b"} {
+			time.Sleep(100 * time.Millisecond)
+			if err := zook.Delete(path); err != nil {
+				t.Errorf("Delete(%q) error %q", path, err)
+			}
+		}
+	}()
+	if empty, err := zook.WaitForNoChildren("/wait", 10*time.Second); err != nil || !empty {
+		t.Errorf("WaitForNoChildren == %t, %v, want true", empty, err)
+	}
+	if empty, err := zook.WaitForNoChildren("/wait/missing", time.Second); err != nil || !empty {
+		t.Errorf("WaitForNoChildren of missing path == %t, %v, want true", empty, err)
+	}
+}
+
+func TestEnsureACLEntry(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	acls := map[string]string{
+		"/ensure":   "world:anyone:cdrwa,digest:monitor:hash:r",
+		"/ensure/a": "world:anyone:cdrwa",
+		"/ensure/b": "world:anyone:cdrwa,digest:monitor:hash:w",
+	}
+	for _, path := range []string{"/ensure", "/ensure/a", "/ensure/b"} {
+		if _, err := zook.Create(path, []byte{}, acls[path], false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	before, err := zook.Stat("/ensure")
+	if err != nil {
+		t.Fatalf("Stat error %q", err)
+	}
+	updated, err := zook.EnsureACLEntry("/ensure", "digest", "monitor:hash", "r", true)
+	if err != nil {
+		t.Fatalf("EnsureACLEntry error %q", err)
+	}
+	sort.Strings(updated)
+	if want := []string{"/ensure/a", "/ensure/b"}; strings.Join(updated, ",") != strings.Join(want, ",") {
+		t.Errorf("EnsureACLEntry updated %v, want %v", updated, want)
+	}
+	// Already present: nothing written
+	if after, err := zook.Stat("/ensure"); err != nil || after.Aversion != before.Aversion {
+		t.Errorf("ACL version of /ensure after EnsureACLEntry == %v, %v, want %d", after, err, before.Aversion)
+	}
+	want := map[string][]string{
+		"/ensure":   {"world:anyone:cdrwa", "digest:monitor:hash:r"},
+		"/ensure/a": {"world:anyone:cdrwa", "digest:monitor:hash:r"},
+		"/ensure/b": {"world:anyone:cdrwa", "digest:monitor:hash:rw"},
+	}
+	for path, wantACL := range want {
+		if acl, err := zook.GetACL(path); err != nil || strings.Join(acl, ",") != strings.Join(wantACL, ",") {
+			t.Errorf("GetACL(%q) == %v, %v, want %v", path, acl, err, wantACL)
+		}
+	}
+	if updated, err := zook.EnsureACLEntry("/ensure", "digest", "monitor:hash", "r", true); err != nil || len(updated) != 0 {
+		t.Errorf("repeated EnsureACLEntry == %v, %v, want no updates", updated, err)
+	}
+}
+
+func TestReplaceACLIdentity(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	acls := map[string]string{
+		"/replace":   "world:anyone:cdrwa,digest:old:hash:r",
+		"/replace/a": "world:anyone:cdrwa,digest:old:hash:rw,digest:new:hash:c",
+		"/replace/b": "world:anyone:cdrwa",
+	}
+	for _, path := range []string{"/replace", "/replace/a", "/replace/b"} {
+		if _, err := zook.Create(path, []byte{}, acls[path], false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	updated, err := zook.ReplaceACLIdentity("/replace", "digest", "old:hash", "digest", "new:hash", true)
+	if err != nil {
+		t.Fatalf("ReplaceACLIdentity error %q", err)
+	}
+	sort.Strings(updated)
+	if want := []string{"/replace", "/replace/a"}; strings.Join(updated, ",") != strings.Join(want, ",") {
+		t.Errorf("ReplaceACLIdentity updated %v, want %v", updated, want)
+	}
+	want := map[string][]string{
+		"/replace":   {"world:anyone:cdrwa", "digest:new:hash:r"},
+		"/replace/a": {"world:anyone:cdrwa", "digest:new:hash:crw"},
+		"/replace/b": {"world:anyone:cdrwa"},
+	}
+	for path, wantACL := range want {
+		if acl, err := zook.GetACL(path); err != nil || strings.Join(acl, ",") != strings.Join(wantACL, ",") {
+			t.Errorf("GetACL(%q) == %v, %v, want %v", path, acl, err, wantACL)
+		}
+	}
+	if updated, err := zook.ReplaceACLIdentity("/replace", "digest", "old:hash", "digest", "new:hash", false); err != nil || len(updated) != 0 {
+		t.Errorf("repeated ReplaceACLIdentity == %v, %v, want no updates", updated, err)
+	}
+}
+
+// eventually polls cond until it holds or timeout elapses, returning whether it held
+func eventually(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestReplicate(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for path, data := range map[string]string{"/src/a": "a", "/src/a/b": "b"} {
+		if _, err := zook.Create(path, []byte(data), "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	stopReplication := make(chan struct{})
+	result := make(chan error, 1)
+	go func() { result <- Replicate(zook, "/src", zook, "/dst", stopReplication) }()
+
+	hasData := func(path string, want string) func() bool {
+		return func() bool {
+			data, err := zook.Get(path)
+			return err == nil && string(data) == want
+		}
+	}
+	if !eventually(5*time.Second, hasData("/dst/a/b", "b")) || !eventually(time.Second, hasData("/dst/a", "a")) {
+		t.Fatalf("initial copy of /src not found under /dst")
+	}
+
+	if _, err := zook.Create("/src/c", []byte("c"), "", false); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	if !eventually(5*time.Second, hasData("/dst/c", "c")) {
+		t.Errorf("creation of /src/c not replicated")
+	}
+	if _, err := zook.Set("/src/a", []byte("a2")); err != nil {
+		t.Fatalf("Set error %q", err)
+	}
+	if !eventually(5*time.Second, hasData("/dst/a", "a2")) {
+		t.Errorf("data change of /src/a not replicated")
+	}
+	if err := zook.Delete("/src/a/b"); err != nil {
+		t.Fatalf("Delete error %q", err)
+	}
+	if !eventually(5*time.Second, func() bool { exists, err := zook.Exists("/dst/a/b"); return err == nil && !exists }) {
+		t.Errorf("deletion of /src/a/b not replicated")
+	}
+
+	close(stopReplication)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Replicate error %q", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Replicate did not return once stopped")
+	}
+}
+
+func TestReplicateSourceDeleted(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	if _, err := zook.Create("/src/a", []byte("a"), "", true); err != nil {
+		t.Fatalf("Create error %q", err)
+	}
+	stopReplication := make(chan struct{})
+	defer close(stopReplication)
+	result := make(chan error, 1)
+	go func() { result <- Replicate(zook, "/src", zook, "/dst", stopReplication) }()
+
+	if !eventually(5*time.Second, func() bool { exists, err := zook.Exists("/dst/a"); return err == nil && exists }) {
+		t.Fatalf("initial copy of /src not found under /dst")
+	}
+	if err := zook.DeleteRecursive("/src"); err != nil {
+		t.Fatalf("DeleteRecursive error %q", err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Replicate error %q", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Replicate did not return once /src was deleted")
+	}
+	if exists, err := zook.Exists("/dst"); err != nil || exists {
+		t.Errorf("Exists(%q) after /src deleted == %t, %v, want false", "/dst", exists, err)
+	}
+}
+
+func TestPredictDeleteFailures(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	for _, path := range []string{"/predict/locked/child", "/predict/leaf", "/predict/nodelete/child"} {
+		if _, err := zook.Create(path, []byte{}, "", true); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	// No read on a parent, a leaf, and no delete on a parent
+	for path, aclstr := range map[string]string{"/predict/locked": "world:anyone:cdwa", "/predict/leaf": "world:anyone:cdwa", "/predict/nodelete": "world:anyone:crwa"} {
+		if _, err := zook.SetACL(path, aclstr, false); err != nil {
+			t.Fatalf("SetACL(%q) error %q", path, err)
+		}
+	}
+	failures, err := zook.PredictDeleteFailures("/predict")
+	if err != nil {
+		t.Fatalf("PredictDeleteFailures error %q", err)
+	}
+	if want := []string{"/predict/locked", "/predict/nodelete/child"}; strings.Join(failures, ",") != strings.Join(want, ",") {
+		t.Errorf("PredictDeleteFailures == %v, want %v", failures, want)
+	}
+	if _, err := zook.PredictDeleteFailures("/predict/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PredictDeleteFailures of missing path error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCleanupByMarker(t *testing.T) {
+	zook, stop := startTestZooKeeper(t)
+	defer stop()
+
+	nodes := map[string]string{
+		"/cleanup":         "other",
+		"/cleanup/a":       "crashed",
+		"/cleanup/a/b":     "crashed",
+		"/cleanup/c":       "crashed",
+		"/cleanup/c/kept":  "other",
+		"/cleanup/c/d":     "crashed",
+		"/cleanup/c/d/e":   "crashed",
+		"/cleanup/another": "other",
+	}
+	for _, path := range []string{"/cleanup", "/cleanup/a", "/cleanup/a/b", "/cleanup/c", "/cleanup/c/kept", "/cleanup/c/d", "/cleanup/c/d/e", "/cleanup/another"} {
+		if _, err := zook.Create(path, []byte(nodes[path]), "", false); err != nil {
+			t.Fatalf("Create(%q) error %q", path, err)
+		}
+	}
+	want := []string{"/cleanup/c/d/e", "/cleanup/c/d", "/cleanup/a/b", "/cleanup/a"}
+	for _, dryRun := range []bool{true, false} {
+		deleted, err := zook.CleanupByMarker("/cleanup", []byte("crashed"), dryRun)
+		if strings.Join(deleted, ",") != strings.Join(want, ",") {
+			t.Errorf("CleanupByMarker with dryRun %t deleted %v, want %v", dryRun, deleted, want)
+		}
+		if !errors.Is(err, ErrNotEmpty) || !strings.Contains(err.Error(), "/cleanup/c:") {
+			t.Errorf("CleanupByMarker with dryRun %t error %v, want /cleanup/c reported as %v", dryRun, err, ErrNotEmpty)
+		}
+	}
+	for path, wantExists := range map[string]bool{"/cleanup/a": false, "/cleanup/c": true, "/cleanup/c/kept": true, "/cleanup/c/d": false} {
+		if exists, err := zook.Exists(path); err != nil || exists != wantExists {
+			t.Errorf("Exists(%q) after CleanupByMarker == %t, %v, want %t", path, exists, err, wantExists)
+		}
+	}
+}